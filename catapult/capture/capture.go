@@ -0,0 +1,125 @@
+// Package capture records the data going through forwarded connections, to
+// debug the protocols spoken through a tunnel without capturing traffic on the
+// server.  The data can be written to a file per connection, to a pcapng file
+// with synthetic TCP framing, or printed as HTTP exchanges.
+package capture
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Direction tells which way captured data went.
+type Direction int
+
+const (
+	// Sent is data going from the local end of a forward to the remote end.
+	Sent Direction = iota
+
+	// Received is data going from the remote end of a forward to the local
+	// end.
+	Received
+)
+
+func (d Direction) String() string {
+	if d == Received {
+		return "<"
+	}
+
+	return ">"
+}
+
+// Conn describes a captured connection.
+type Conn struct {
+	// ID identifies the connection within the tunnel, as in its log records.
+	ID uint64
+
+	// Peer is the address of the client of the local end of the forward.  It
+	// may be nil.
+	Peer net.Addr
+
+	// Local and Remote are the ends of the forward.
+	Local  net.Addr
+	Remote net.Addr
+
+	// Started is when the connection was accepted.
+	Started time.Time
+}
+
+// Writer records captured connections.  Its methods are called concurrently.
+type Writer interface {
+	// Open starts recording a connection.
+	Open(conn Conn) (Stream, error)
+
+	// Close stops recording, once every stream is closed.
+	Close() error
+}
+
+// Stream records the data of a single connection.  Write is called from the
+// goroutines copying both directions, and Close once both are done.
+type Stream interface {
+	// Write records the data, which must not be retained, as going in the
+	// direction at the current time.  A failure is reported by Close.
+	Write(direction Direction, data []byte)
+
+	// Close stops recording the connection and returns the first error met
+	// while recording it.
+	Close() error
+}
+
+// Multi returns a writer recording connections with all the writers.
+func Multi(writers ...Writer) Writer {
+	return multiWriter(writers)
+}
+
+type multiWriter []Writer
+
+func (w multiWriter) Open(conn Conn) (Stream, error) {
+	streams := make(multiStream, 0, len(w))
+	for _, writer := range w {
+		stream, err := writer.Open(conn)
+		if err != nil {
+			streams.Close()
+			return nil, err
+		}
+		streams = append(streams, stream)
+	}
+
+	return streams, nil
+}
+
+func (w multiWriter) Close() error {
+	var errs []error
+	for _, writer := range w {
+		errs = append(errs, writer.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+type multiStream []Stream
+
+func (s multiStream) Write(direction Direction, data []byte) {
+	for _, stream := range s {
+		stream.Write(direction, data)
+	}
+}
+
+func (s multiStream) Close() error {
+	var errs []error
+	for _, stream := range s {
+		errs = append(errs, stream.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// addrString returns the address as network:address, or - when there is none.
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return "-"
+	}
+
+	return addr.Network() + ":" + addr.String()
+}
@@ -0,0 +1,323 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type write struct {
+	direction Direction
+	data      string
+}
+
+func testConn(remote net.Addr) Conn {
+	return Conn{
+		ID:      7,
+		Peer:    &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000},
+		Local:   &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2375},
+		Remote:  remote,
+		Started: time.Now(),
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catapult")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	directory, err := NewDirectory(filepath.Join(dir, "capture"))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	stream, err := directory.Open(testConn(&net.UnixAddr{Name: "/var/run/docker.sock", Net: "unix"}))
+	if !assert.Nil(t, err) {
+		return
+	}
+	stream.Write(Sent, []byte("hello"))
+	stream.Write(Received, []byte("world!"))
+	assert.Nil(t, stream.Close())
+	assert.Nil(t, directory.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, "capture", "*-conn7.txt"))
+	if !assert.Nil(t, err) || !assert.Len(t, files, 1) {
+		return
+	}
+
+	info, err := os.Stat(files[0])
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	content, err := ioutil.ReadFile(files[0])
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), "conn 7 peer=tcp:127.0.0.1:40000 local=tcp:127.0.0.1:2375 remote=unix:/var/run/docker.sock")
+	assert.Contains(t, string(content), "> 5 bytes\n00000000  68 65 6c 6c 6f")
+	assert.Contains(t, string(content), "< 6 bytes\n00000000  77 6f 72 6c 64 21")
+}
+
+// segment is a TCP segment read back from a pcapng file.
+type segment struct {
+	srcPort uint16
+	dstPort uint16
+	seq     uint32
+	flags   byte
+	payload []byte
+	comment string
+}
+
+// readPcapng reads the segments of a pcapng file written by Pcapng, checking
+// the block structure and the checksums.
+func readPcapng(t *testing.T, data []byte) []segment {
+	var segments []segment
+	var types []uint32
+	for len(data) >= 12 {
+		blockType := binary.LittleEndian.Uint32(data)
+		length := binary.LittleEndian.Uint32(data[4:])
+		if !assert.True(t, length%4 == 0 && int(length) <= len(data)) {
+			return nil
+		}
+		assert.Equal(t, length, binary.LittleEndian.Uint32(data[length-4:]))
+		types = append(types, blockType)
+
+		if blockType == blockEnhancedPacket {
+			body := data[8 : length-4]
+			captured := binary.LittleEndian.Uint32(body[12:])
+			packet := body[20 : 20+captured]
+			assert.Equal(t, uint16(0), checksum(packet[:ipv4HeaderLength], 0))
+
+			tcp := packet[ipv4HeaderLength:]
+			pseudo := uint32(6) + uint32(len(tcp))
+			for i := 12; i < 20; i += 2 {
+				pseudo += uint32(binary.BigEndian.Uint16(packet[i:]))
+			}
+			assert.Equal(t, uint16(0), checksum(tcp, pseudo))
+
+			s := segment{
+				srcPort: binary.BigEndian.Uint16(tcp),
+				dstPort: binary.BigEndian.Uint16(tcp[2:]),
+				seq:     binary.BigEndian.Uint32(tcp[4:]),
+				flags:   tcp[13],
+				payload: tcp[tcpHeaderLength:],
+			}
+			options := body[20+int(captured)+padding(int(captured)):]
+			if len(options) >= 4 && binary.LittleEndian.Uint16(options) == optionComment {
+				s.comment = string(options[4 : 4+binary.LittleEndian.Uint16(options[2:])])
+			}
+			segments = append(segments, s)
+		}
+
+		data = data[length:]
+	}
+	assert.Empty(t, data)
+
+	if assert.True(t, len(types) >= 2) {
+		assert.Equal(t, []uint32{blockSectionHeader, blockInterface}, types[:2])
+	}
+
+	return segments
+}
+
+func TestPcapng(t *testing.T) {
+	large := strings.Repeat("x", maxSegmentLength+10)
+
+	testcases := []struct {
+		remote net.Addr
+		writes []write
+
+		expectedServerPort uint16
+		expectedSegments   int
+		expectedSent       string
+		expectedReceived   string
+	}{
+		// Server port taken from the remote end of the forward
+		{
+			remote:             &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2375},
+			writes:             []write{{Sent, "ping"}, {Received, "pong"}},
+			expectedServerPort: 2375,
+			expectedSegments:   8,
+			expectedSent:       "ping",
+			expectedReceived:   "pong",
+		},
+		// Unix domain socket captured as HTTP port
+		{
+			remote:             &net.UnixAddr{Name: "/var/run/docker.sock", Net: "unix"},
+			writes:             []write{{Sent, "GET /_ping HTTP/1.1\r\n\r\n"}},
+			expectedServerPort: 80,
+			expectedSegments:   7,
+			expectedSent:       "GET /_ping HTTP/1.1\r\n\r\n",
+		},
+		// Data larger than a segment split in several
+		{
+			remote:             &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5432},
+			writes:             []write{{Received, large}},
+			expectedServerPort: 5432,
+			expectedSegments:   8,
+			expectedReceived:   large,
+		},
+	}
+
+	for _, testcase := range testcases {
+		var buffer bytes.Buffer
+		pcapng, err := NewPcapng(&buffer)
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		stream, err := pcapng.Open(testConn(testcase.remote))
+		if !assert.Nil(t, err) {
+			continue
+		}
+		for _, w := range testcase.writes {
+			stream.Write(w.direction, []byte(w.data))
+		}
+		assert.Nil(t, stream.Close())
+		assert.Nil(t, pcapng.Close())
+
+		segments := readPcapng(t, buffer.Bytes())
+		if !assert.Len(t, segments, testcase.expectedSegments) {
+			continue
+		}
+
+		assert.Equal(t, byte(tcpFlagSYN), segments[0].flags)
+		assert.Equal(t, testcase.expectedServerPort, segments[0].dstPort)
+		assert.Contains(t, segments[0].comment, "conn 7 peer=tcp:127.0.0.1:40000")
+
+		// Sequence numbers follow the data sent by either end.
+		var sent, received []byte
+		nextSeq := map[uint16]uint32{}
+		for _, s := range segments[3 : len(segments)-3] {
+			if expected, ok := nextSeq[s.srcPort]; ok {
+				assert.Equal(t, expected, s.seq)
+			}
+			nextSeq[s.srcPort] = s.seq + uint32(len(s.payload))
+
+			if s.srcPort == testcase.expectedServerPort {
+				received = append(received, s.payload...)
+			} else {
+				sent = append(sent, s.payload...)
+			}
+		}
+		assert.Equal(t, testcase.expectedSent, string(sent))
+		assert.Equal(t, testcase.expectedReceived, string(received))
+		assert.Equal(t, byte(tcpFlagFIN|tcpFlagACK), segments[len(segments)-3].flags)
+	}
+}
+
+func TestHTTPPrinter(t *testing.T) {
+	testcases := []struct {
+		writes []write
+
+		expectedLines []string
+		missingLines  []string
+	}{
+		// Request and JSON response, written in several chunks
+		{
+			writes: []write{
+				{Sent, "GET /v1.43/containers/json HTTP/1.1\r\nHost: docker\r\n"},
+				{Sent, "User-Agent: Docker-Client\r\n\r\n"},
+				{Received, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 18\r\n\r\n"},
+				{Received, `[{"Id":"abc123"}]` + "\n"},
+			},
+			expectedLines: []string{
+				"conn 7 > GET /v1.43/containers/json HTTP/1.1",
+				"conn 7 > Host: docker",
+				"conn 7 > User-Agent: Docker-Client",
+				"conn 7 < HTTP/1.1 200 OK",
+				"conn 7 < Content-Type: application/json",
+				"conn 7 < [",
+				`conn 7 <     "Id": "abc123"`,
+			},
+		},
+		// Credentials not printed
+		{
+			writes: []write{
+				{Sent, "POST /v1.43/images/create?fromImage=private HTTP/1.1\r\nHost: docker\r\nX-Registry-Auth: c2VjcmV0\r\nContent-Length: 0\r\n\r\n"},
+				{Received, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"},
+			},
+			expectedLines: []string{
+				"conn 7 > X-Registry-Auth: (redacted)",
+				"conn 7 < Transfer-Encoding: chunked",
+				"conn 7 < hello",
+			},
+			missingLines: []string{"c2VjcmV0"},
+		},
+		// Upgraded connection only counted
+		{
+			writes: []write{
+				{Sent, "POST /v1.43/containers/abc123/attach?stream=1 HTTP/1.1\r\nHost: docker\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n"},
+				{Received, "HTTP/1.1 101 UPGRADED\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n"},
+				{Sent, "ls\n"},
+				{Received, "\x01\x00\x00\x00\x00\x00\x00\x04bin\n"},
+			},
+			expectedLines: []string{
+				"conn 7 < HTTP/1.1 101 UPGRADED",
+				"conn 7 > (3 bytes of non-HTTP data)",
+				"conn 7 < (12 bytes of non-HTTP data)",
+			},
+		},
+		// Data that is not HTTP
+		{
+			writes: []write{
+				{Sent, "\x16\x03\x01\x02\x00"},
+			},
+			expectedLines: []string{
+				"conn 7 > (5 bytes of non-HTTP data)",
+			},
+		},
+	}
+
+	for _, testcase := range testcases {
+		var buffer bytes.Buffer
+		printer := NewHTTPPrinter(&buffer)
+
+		stream, err := printer.Open(testConn(&net.UnixAddr{Name: "/var/run/docker.sock", Net: "unix"}))
+		if !assert.Nil(t, err) {
+			continue
+		}
+		for _, w := range testcase.writes {
+			stream.Write(w.direction, []byte(w.data))
+		}
+		assert.Nil(t, stream.Close())
+		assert.Nil(t, printer.Close())
+
+		output := buffer.String()
+		for _, line := range testcase.expectedLines {
+			assert.Contains(t, output, line+"\n")
+		}
+		for _, line := range testcase.missingLines {
+			assert.NotContains(t, output, line)
+		}
+	}
+}
+
+func TestMulti(t *testing.T) {
+	var pcapngBuffer, httpBuffer bytes.Buffer
+	pcapng, err := NewPcapng(&pcapngBuffer)
+	if !assert.Nil(t, err) {
+		return
+	}
+	writer := Multi(pcapng, NewHTTPPrinter(&httpBuffer))
+
+	stream, err := writer.Open(testConn(&net.UnixAddr{Name: "/var/run/docker.sock", Net: "unix"}))
+	if !assert.Nil(t, err) {
+		return
+	}
+	stream.Write(Sent, []byte("GET /_ping HTTP/1.1\r\nHost: docker\r\n\r\n"))
+	assert.Nil(t, stream.Close())
+	assert.Nil(t, writer.Close())
+
+	assert.Len(t, readPcapng(t, pcapngBuffer.Bytes()), 7)
+	assert.Contains(t, httpBuffer.String(), "conn 7 > GET /_ping HTTP/1.1\n")
+}
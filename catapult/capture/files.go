@@ -0,0 +1,81 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Directory writes every connection to its own file in a directory: a header
+// describing the connection, followed by the time, direction and hex dump of
+// every chunk of data.
+type Directory struct {
+	dir string
+}
+
+// NewDirectory returns a writer creating its files in the directory, which is
+// created, accessible by the current user only, if needed.
+func NewDirectory(dir string) (*Directory, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create capture directory.  Error: %s", err)
+	}
+
+	return &Directory{dir: dir}, nil
+}
+
+// Open creates the file of the connection, named after the time it started
+// and its ID.
+func (d *Directory) Open(conn Conn) (Stream, error) {
+	name := fmt.Sprintf("%s-conn%d.txt", conn.Started.UTC().Format("20060102T150405.000000"), conn.ID)
+	file, err := os.OpenFile(filepath.Join(d.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &fileStream{file: file, writer: bufio.NewWriter(file)}
+	_, s.err = fmt.Fprintf(s.writer, "conn %d peer=%s local=%s remote=%s started=%s\n",
+		conn.ID, addrString(conn.Peer), addrString(conn.Local), addrString(conn.Remote), conn.Started.UTC().Format(time.RFC3339Nano))
+
+	return s, nil
+}
+
+// Close does nothing, the files being closed with their stream.
+func (d *Directory) Close() error {
+	return nil
+}
+
+type fileStream struct {
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	err    error
+}
+
+func (s *fileStream) Write(direction Direction, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err != nil {
+		return
+	}
+
+	_, s.err = fmt.Fprintf(s.writer, "\n%s %s %d bytes\n%s", time.Now().UTC().Format(time.RFC3339Nano), direction, len(data), hex.Dump(data))
+}
+
+func (s *fileStream) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.writer.Flush(); s.err == nil {
+		s.err = err
+	}
+	if err := s.file.Close(); s.err == nil {
+		s.err = err
+	}
+
+	return s.err
+}
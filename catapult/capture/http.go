@@ -0,0 +1,316 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// maxPrintedBody is the number of bytes of a body printed by HTTPPrinter.
+const maxPrintedBody = 4096
+
+// redactedHeaders are the headers whose values HTTPPrinter does not print, as
+// they hold credentials.  Docker passes registry credentials in
+// X-Registry-Auth and X-Registry-Config.
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"X-Registry-Auth":     true,
+	"X-Registry-Config":   true,
+}
+
+// HTTPPrinter prints the HTTP requests and responses exchanged through
+// connections, such as the Docker Engine API calls made through a tunnel to
+// /var/run/docker.sock.  Every message is printed with its headers, apart from
+// the values of those holding credentials, and the beginning of its body, JSON
+// bodies being indented.  Data that is not HTTP, such as the raw stream of an
+// attached container, is only counted.
+type HTTPPrinter struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+// NewHTTPPrinter returns a writer printing to the writer, which is closed with
+// it if it is an io.Closer.
+func NewHTTPPrinter(writer io.Writer) *HTTPPrinter {
+	return &HTTPPrinter{writer: writer}
+}
+
+// Open starts parsing both directions of the connection.
+func (p *HTTPPrinter) Open(conn Conn) (Stream, error) {
+	sentReader, sentWriter := io.Pipe()
+	receivedReader, receivedWriter := io.Pipe()
+
+	s := &httpStream{
+		printer:  p,
+		id:       conn.ID,
+		sent:     sentWriter,
+		received: receivedWriter,
+	}
+	s.wg.Add(2)
+	go s.readRequests(sentReader)
+	go s.readResponses(receivedReader)
+
+	return s, nil
+}
+
+// Close closes the underlying writer if it is an io.Closer.
+func (p *HTTPPrinter) Close() error {
+	if closer, ok := p.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// print writes the lines of a message at once, prefixed with the connection
+// and direction, the first one also with the time.
+func (p *HTTPPrinter) print(id uint64, direction Direction, lines []string) error {
+	var buffer bytes.Buffer
+	for i, line := range lines {
+		if i == 0 {
+			fmt.Fprintf(&buffer, "%s ", time.Now().UTC().Format(time.RFC3339Nano))
+		}
+		fmt.Fprintf(&buffer, "conn %d %s %s\n", id, direction, line)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	_, err := p.writer.Write(buffer.Bytes())
+	return err
+}
+
+// httpStream parses each direction of a connection in its own goroutine, fed
+// through a pipe.  The goroutines always read their pipe to its end, so that
+// forwarding never waits for data that cannot be parsed.
+type httpStream struct {
+	printer  *HTTPPrinter
+	id       uint64
+	sent     *io.PipeWriter
+	received *io.PipeWriter
+	wg       sync.WaitGroup
+
+	mutex sync.Mutex
+	// methods holds the methods of the requests waiting for a response, which
+	// tell whether the response has a body.
+	methods []string
+	err     error
+}
+
+func (s *httpStream) Write(direction Direction, data []byte) {
+	if direction == Sent {
+		s.sent.Write(data)
+	} else {
+		s.received.Write(data)
+	}
+}
+
+func (s *httpStream) Close() error {
+	s.sent.Close()
+	s.received.Close()
+	s.wg.Wait()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.err
+}
+
+func (s *httpStream) print(direction Direction, lines []string) {
+	if err := s.printer.print(s.id, direction, lines); err != nil {
+		s.mutex.Lock()
+		if s.err == nil {
+			s.err = err
+		}
+		s.mutex.Unlock()
+	}
+}
+
+func (s *httpStream) readRequests(reader *io.PipeReader) {
+	defer s.wg.Done()
+	defer reader.Close()
+
+	counted := &countingReader{Reader: reader}
+	buffered := bufio.NewReader(counted)
+	for {
+		if _, err := buffered.Peek(1); err != nil {
+			return
+		}
+
+		start := counted.n - int64(buffered.Buffered())
+		request, err := http.ReadRequest(buffered)
+		if err != nil {
+			s.printRaw(Sent, buffered, counted, start)
+			return
+		}
+
+		s.mutex.Lock()
+		s.methods = append(s.methods, request.Method)
+		s.mutex.Unlock()
+
+		lines := []string{fmt.Sprintf("%s %s %s", request.Method, request.RequestURI, request.Proto), "Host: " + request.Host}
+		lines = append(lines, headerLines(request.Header, request.TransferEncoding)...)
+		s.print(Sent, lines)
+		s.printBody(Sent, request.Header, request.Body)
+
+		// Once a connection is upgraded, such as to attach to a container,
+		// the data is no longer HTTP.
+		if request.Header.Get("Upgrade") != "" {
+			s.printRaw(Sent, buffered, counted, counted.n-int64(buffered.Buffered()))
+			return
+		}
+	}
+}
+
+func (s *httpStream) readResponses(reader *io.PipeReader) {
+	defer s.wg.Done()
+	defer reader.Close()
+
+	counted := &countingReader{Reader: reader}
+	buffered := bufio.NewReader(counted)
+	for {
+		if _, err := buffered.Peek(1); err != nil {
+			return
+		}
+
+		start := counted.n - int64(buffered.Buffered())
+		response, err := http.ReadResponse(buffered, &http.Request{Method: s.nextMethod()})
+		if err != nil {
+			s.printRaw(Received, buffered, counted, start)
+			return
+		}
+
+		lines := []string{fmt.Sprintf("%s %s", response.Proto, response.Status)}
+		lines = append(lines, headerLines(response.Header, response.TransferEncoding)...)
+		s.print(Received, lines)
+		s.printBody(Received, response.Header, response.Body)
+
+		if response.StatusCode == http.StatusSwitchingProtocols {
+			s.printRaw(Received, buffered, counted, counted.n-int64(buffered.Buffered()))
+			return
+		}
+	}
+}
+
+// nextMethod returns the method of the oldest request waiting for a response,
+// or GET if it was not parsed yet.
+func (s *httpStream) nextMethod() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.methods) == 0 {
+		return http.MethodGet
+	}
+
+	method := s.methods[0]
+	s.methods = s.methods[1:]
+
+	return method
+}
+
+// printBody prints the beginning of the body, indented if it is JSON, and the
+// size of the rest.  Bodies that are not text are only counted.
+func (s *httpStream) printBody(direction Direction, header http.Header, body io.ReadCloser) {
+	defer body.Close()
+
+	buffer := make([]byte, maxPrintedBody)
+	n, _ := io.ReadFull(body, buffer)
+	buffer = buffer[:n]
+	rest, _ := io.Copy(io.Discard, body)
+	if n == 0 {
+		return
+	}
+
+	if !isText(buffer) {
+		s.print(direction, []string{fmt.Sprintf("(%d bytes of %s)", int64(n)+rest, contentType(header))})
+		return
+	}
+
+	if rest == 0 && strings.Contains(header.Get("Content-Type"), "json") {
+		var indented bytes.Buffer
+		if json.Indent(&indented, buffer, "", "  ") == nil {
+			buffer = indented.Bytes()
+		}
+	}
+
+	lines := strings.Split(strings.TrimRight(string(buffer), "\r\n"), "\n")
+	if rest > 0 {
+		lines = append(lines, fmt.Sprintf("(%d more bytes)", rest))
+	}
+	s.print(direction, lines)
+}
+
+// printRaw reads the rest of the data, which is not HTTP, and prints its size
+// counted from start, the position in the counted data where it begins.
+func (s *httpStream) printRaw(direction Direction, buffered *bufio.Reader, counted *countingReader, start int64) {
+	io.Copy(io.Discard, buffered)
+	if n := counted.n - start; n > 0 {
+		s.print(direction, []string{fmt.Sprintf("(%d bytes of non-HTTP data)", n)})
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+
+	return n, err
+}
+
+// headerLines returns the header as sorted Name: value lines.
+func headerLines(header http.Header, transferEncoding []string) []string {
+	var lines []string
+	for name, values := range header {
+		for _, value := range values {
+			if redactedHeaders[name] {
+				value = "(redacted)"
+			}
+			lines = append(lines, name+": "+value)
+		}
+	}
+	if len(transferEncoding) > 0 {
+		lines = append(lines, "Transfer-Encoding: "+strings.Join(transferEncoding, ", "))
+	}
+	sort.Strings(lines)
+
+	return lines
+}
+
+func contentType(header http.Header) string {
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		return contentType
+	}
+
+	return "binary data"
+}
+
+// isText tells whether the data is UTF-8 text without control characters other
+// than whitespace.  The data may end in the middle of a character.
+func isText(data []byte) bool {
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size == 1 && len(data) >= utf8.UTFMax {
+			return false
+		}
+		if r < ' ' && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+		data = data[size:]
+	}
+
+	return true
+}
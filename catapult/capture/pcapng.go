@@ -0,0 +1,280 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	blockSectionHeader   = 0x0a0d0d0a
+	blockInterface       = 0x00000001
+	blockEnhancedPacket  = 0x00000006
+	byteOrderMagic       = 0x1a2b3c4d
+	optionEnd            = 0
+	optionComment        = 1
+	optionInterfaceName  = 2
+	optionUserAppl       = 4
+	linkTypeRaw          = 101
+	ipv4HeaderLength     = 20
+	tcpHeaderLength      = 20
+	maxSegmentLength     = 65535 - ipv4HeaderLength - tcpHeaderLength
+	tcpFlagFIN           = 0x01
+	tcpFlagSYN           = 0x02
+	tcpFlagPSH           = 0x08
+	tcpFlagACK           = 0x10
+	defaultServerPort    = 80
+	firstClientPort      = 1024
+	initialSequenceValue = 1
+)
+
+// clientIP and serverIP are the synthetic addresses of the ends of every
+// captured connection, taken from the range reserved for documentation.
+var (
+	clientIP = net.IPv4(192, 0, 2, 1).To4()
+	serverIP = net.IPv4(192, 0, 2, 2).To4()
+)
+
+// Pcapng writes connections to a pcapng file, as TCP segments over IPv4
+// between synthetic addresses, so that tools such as Wireshark dissect the
+// protocols spoken through the tunnel.  Every connection gets its own client
+// port, and the server port is the one of the remote end of the forward, or
+// 80 for a Unix domain socket, such as Docker's, so that HTTP is recognized.
+// The first segment of every connection carries a comment describing it.
+type Pcapng struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	err    error
+}
+
+// NewPcapng writes the pcapng section and interface headers and returns a
+// writer appending the connections to the writer, which is closed with it if
+// it is an io.Closer.
+func NewPcapng(writer io.Writer) (*Pcapng, error) {
+	p := &Pcapng{writer: writer}
+
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, uint32(byteOrderMagic))
+	binary.Write(&body, binary.LittleEndian, uint16(1))
+	binary.Write(&body, binary.LittleEndian, uint16(0))
+	binary.Write(&body, binary.LittleEndian, int64(-1))
+	writeOption(&body, optionUserAppl, []byte("catapult"))
+	writeOption(&body, optionEnd, nil)
+	p.writeBlock(blockSectionHeader, body.Bytes())
+
+	body.Reset()
+	binary.Write(&body, binary.LittleEndian, uint16(linkTypeRaw))
+	binary.Write(&body, binary.LittleEndian, uint16(0))
+	binary.Write(&body, binary.LittleEndian, uint32(0))
+	writeOption(&body, optionInterfaceName, []byte("catapult"))
+	writeOption(&body, optionEnd, nil)
+	p.writeBlock(blockInterface, body.Bytes())
+
+	if p.err != nil {
+		return nil, fmt.Errorf("failed to write pcapng header.  Error: %s", p.err)
+	}
+
+	return p, nil
+}
+
+// Open records the handshake of the connection.
+func (p *Pcapng) Open(conn Conn) (Stream, error) {
+	s := &pcapngStream{
+		pcapng:     p,
+		clientPort: uint16(firstClientPort + conn.ID%(65536-firstClientPort)),
+		serverPort: defaultServerPort,
+		clientSeq:  initialSequenceValue,
+		serverSeq:  initialSequenceValue,
+	}
+	if addr, ok := conn.Remote.(*net.TCPAddr); ok && addr.Port != 0 {
+		s.serverPort = uint16(addr.Port)
+	}
+
+	comment := fmt.Sprintf("conn %d peer=%s local=%s remote=%s", conn.ID, addrString(conn.Peer), addrString(conn.Local), addrString(conn.Remote))
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	s.segment(now, Sent, tcpFlagSYN, nil, comment)
+	s.clientSeq++
+	s.segment(now, Received, tcpFlagSYN|tcpFlagACK, nil, "")
+	s.serverSeq++
+	s.segment(now, Sent, tcpFlagACK, nil, "")
+
+	return s, p.err
+}
+
+// Close closes the underlying writer if it is an io.Closer.
+func (p *Pcapng) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if closer, ok := p.writer.(io.Closer); ok {
+		if err := closer.Close(); p.err == nil {
+			p.err = err
+		}
+	}
+
+	return p.err
+}
+
+// writeBlock writes a block with the provided body, which must be padded to 32
+// bits.  The first error is kept and stops further writes.
+func (p *Pcapng) writeBlock(blockType uint32, body []byte) {
+	if p.err != nil {
+		return
+	}
+
+	length := uint32(12 + len(body))
+	block := make([]byte, 0, length)
+	block = binary.LittleEndian.AppendUint32(block, blockType)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+
+	_, p.err = p.writer.Write(block)
+}
+
+// writeOption writes a block option, padded to 32 bits.
+func writeOption(buffer *bytes.Buffer, code uint16, value []byte) {
+	binary.Write(buffer, binary.LittleEndian, code)
+	binary.Write(buffer, binary.LittleEndian, uint16(len(value)))
+	buffer.Write(value)
+	buffer.Write(make([]byte, padding(len(value))))
+}
+
+func padding(n int) int {
+	return (4 - n%4) % 4
+}
+
+type pcapngStream struct {
+	pcapng     *Pcapng
+	clientPort uint16
+	serverPort uint16
+
+	// clientSeq and serverSeq are the sequence numbers of the next byte
+	// sent by either end, guarded by the mutex of the Pcapng.
+	clientSeq uint32
+	serverSeq uint32
+}
+
+func (s *pcapngStream) Write(direction Direction, data []byte) {
+	s.pcapng.mutex.Lock()
+	defer s.pcapng.mutex.Unlock()
+
+	now := time.Now()
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxSegmentLength {
+			n = maxSegmentLength
+		}
+
+		s.segment(now, direction, tcpFlagPSH|tcpFlagACK, data[:n], "")
+		if direction == Sent {
+			s.clientSeq += uint32(n)
+		} else {
+			s.serverSeq += uint32(n)
+		}
+		data = data[n:]
+	}
+}
+
+// Close records the closing handshake of the connection.
+func (s *pcapngStream) Close() error {
+	s.pcapng.mutex.Lock()
+	defer s.pcapng.mutex.Unlock()
+
+	now := time.Now()
+	s.segment(now, Sent, tcpFlagFIN|tcpFlagACK, nil, "")
+	s.clientSeq++
+	s.segment(now, Received, tcpFlagFIN|tcpFlagACK, nil, "")
+	s.serverSeq++
+	s.segment(now, Sent, tcpFlagACK, nil, "")
+
+	return s.pcapng.err
+}
+
+// segment writes an enhanced packet block holding a TCP segment with the
+// payload going in the direction.  It must be called with the mutex of the
+// Pcapng held.
+func (s *pcapngStream) segment(at time.Time, direction Direction, flags byte, payload []byte, comment string) {
+	srcIP, dstIP := clientIP, serverIP
+	srcPort, dstPort := s.clientPort, s.serverPort
+	seq, ack := s.clientSeq, s.serverSeq
+	if direction == Received {
+		srcIP, dstIP = serverIP, clientIP
+		srcPort, dstPort = s.serverPort, s.clientPort
+		seq, ack = s.serverSeq, s.clientSeq
+	}
+	if flags&tcpFlagACK == 0 {
+		ack = 0
+	}
+
+	packet := make([]byte, ipv4HeaderLength+tcpHeaderLength, ipv4HeaderLength+tcpHeaderLength+len(payload))
+	ip := packet[:ipv4HeaderLength]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(packet)+len(payload)))
+	binary.BigEndian.PutUint16(ip[6:], 0x4000)
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:], srcIP)
+	copy(ip[16:], dstIP)
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+	tcp := packet[ipv4HeaderLength:]
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = tcpHeaderLength / 4 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	packet = append(packet, payload...)
+	tcp = packet[ipv4HeaderLength:]
+
+	// The TCP checksum covers a pseudo header made of the addresses, the
+	// protocol and the length of the segment.
+	pseudo := uint32(6) + uint32(len(tcp))
+	for i := 0; i < 4; i += 2 {
+		pseudo += uint32(binary.BigEndian.Uint16(srcIP[i:])) + uint32(binary.BigEndian.Uint16(dstIP[i:]))
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudo))
+
+	micros := uint64(at.UnixMicro())
+
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, uint32(0))
+	binary.Write(&body, binary.LittleEndian, uint32(micros>>32))
+	binary.Write(&body, binary.LittleEndian, uint32(micros))
+	binary.Write(&body, binary.LittleEndian, uint32(len(packet)))
+	binary.Write(&body, binary.LittleEndian, uint32(len(packet)))
+	body.Write(packet)
+	body.Write(make([]byte, padding(len(packet))))
+	if comment != "" {
+		writeOption(&body, optionComment, []byte(comment))
+		writeOption(&body, optionEnd, nil)
+	}
+
+	s.pcapng.writeBlock(blockEnhancedPacket, body.Bytes())
+}
+
+// checksum returns the internet checksum of the data, starting from the
+// provided sum.
+func checksum(data []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
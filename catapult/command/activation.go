@@ -0,0 +1,127 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// systemdPrefix selects, as the local address, a socket passed by systemd
+// socket activation, optionally followed by its FileDescriptorName.
+const systemdPrefix = "systemd:"
+
+// listenFdsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFdsStart = 3
+
+// systemdListeners returns the listeners passed by systemd socket activation,
+// by the names given in LISTEN_FDNAMES, or none when the process was not
+// socket activated.  The environment variables describing them are cleared so
+// that child processes do not believe they were passed sockets too.
+func systemdListeners() (map[string]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	listeners := make(map[string]net.Listener, count)
+
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(listenFdsStart+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			closeAll(listeners)
+			return nil, fmt.Errorf("failed to use socket %s passed by systemd.  Error: %s", name, err)
+		}
+
+		if _, ok := listeners[name]; ok {
+			listener.Close()
+			closeAll(listeners)
+			return nil, fmt.Errorf("several sockets passed by systemd are named %s, set distinct FileDescriptorName values", name)
+		}
+		listeners[name] = listener
+	}
+
+	return listeners, nil
+}
+
+// activatedListener returns the listener passed by systemd socket activation
+// with the provided name, or the only one passed when the name is empty.  The
+// other listeners passed are closed.
+func activatedListener(name string) (net.Listener, error) {
+	listeners, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no socket was passed by systemd, the %s local address requires socket activation", systemdPrefix)
+	}
+
+	if name == "" && len(listeners) == 1 {
+		for _, listener := range listeners {
+			return listener, nil
+		}
+	}
+
+	listener, ok := listeners[name]
+	if !ok {
+		names := make([]string, 0, len(listeners))
+		for n := range listeners {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		closeAll(listeners)
+
+		if name == "" {
+			return nil, fmt.Errorf("several sockets were passed by systemd, select one of %s with %sNAME", strings.Join(names, ", "), systemdPrefix)
+		}
+		return nil, fmt.Errorf("no socket named %s was passed by systemd, passed sockets are %s", name, strings.Join(names, ", "))
+	}
+
+	delete(listeners, name)
+	closeAll(listeners)
+
+	return listener, nil
+}
+
+func closeAll(listeners map[string]net.Listener) {
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
+
+// parseLocalAddress parses the local address of the tunnel, returning along
+// with it the listener passed by systemd when it has the systemd: prefix.
+func parseLocalAddress(address string) (net.Addr, net.Listener, error) {
+	if !strings.HasPrefix(address, systemdPrefix) {
+		local, err := parseAddress(address)
+		return local, nil, err
+	}
+
+	listener, err := activatedListener(strings.TrimPrefix(address, systemdPrefix))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return listener.Addr(), listener, nil
+}
@@ -0,0 +1,77 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/marcboudreau/go-devops-talk/catapult/capture"
+)
+
+var captureDir string
+
+var capturePcapngFilename string
+
+var captureHTTPFilename string
+
+// setupCapture returns the writer recording the forwarded connections as
+// requested by the flags, or nil when capture is not enabled.  The caller
+// closes it once the tunnel is shut down, while the writers already opened
+// are closed when it fails.
+func setupCapture() (_ capture.Writer, err error) {
+	var writers []capture.Writer
+	defer func() {
+		if err != nil {
+			for _, writer := range writers {
+				writer.Close()
+			}
+		}
+	}()
+
+	if captureDir != "" {
+		directory, err := capture.NewDirectory(captureDir)
+		if err != nil {
+			return nil, err
+		}
+		writers = append(writers, directory)
+	}
+
+	if capturePcapngFilename != "" {
+		file, err := os.OpenFile(capturePcapngFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create capture file %s.  Error: %s", capturePcapngFilename, err)
+		}
+
+		pcapng, err := capture.NewPcapng(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		writers = append(writers, pcapng)
+	}
+
+	if captureHTTPFilename != "" {
+		// Standard error is wrapped so that closing the printer leaves it open.
+		var writer io.Writer = struct{ io.Writer }{os.Stderr}
+		if captureHTTPFilename != "-" {
+			file, err := os.OpenFile(captureHTTPFilename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open capture file %s.  Error: %s", captureHTTPFilename, err)
+			}
+			writer = file
+		}
+		writers = append(writers, capture.NewHTTPPrinter(writer))
+	}
+
+	if len(writers) == 0 {
+		return nil, nil
+	}
+
+	logger.Warn("capturing forwarded traffic, captures may hold credentials and other sensitive data",
+		"capture_dir", captureDir,
+		"capture_pcapng", capturePcapngFilename,
+		"capture_http", captureHTTPFilename,
+	)
+
+	return capture.Multi(writers...), nil
+}
@@ -0,0 +1,236 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcboudreau/go-devops-talk/catapult"
+	"github.com/marcboudreau/go-devops-talk/catapult/trace"
+	"github.com/marcboudreau/go-devops-talk/catapult/tunnel"
+	"github.com/marcboudreau/go-devops-talk/catapult/vault"
+	"golang.org/x/crypto/ssh"
+)
+
+var keySigningService catapult.KeySigningService
+
+// certificateSigners signs the public key for each distinct username, so that
+// every hop can require its own principal, and caches the resulting signers
+// until their certificate expires.  It is safe for concurrent use.
+type certificateSigners struct {
+	privateKey []byte
+	publicKey  []byte
+
+	mutex   sync.Mutex
+	signers map[string]ssh.Signer
+}
+
+// loadSigners reads the SSH key pair and creates the key signing service.
+func loadSigners() (*certificateSigners, error) {
+	publicKey, err := ioutil.ReadFile(publicKeyFilename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key file %s.  Error: %s", publicKeyFilename, err)
+	}
+
+	privateKey, err := ioutil.ReadFile(privateKeyFilename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key file %s.  Error: %s", privateKeyFilename, err)
+	}
+
+	// Creating the client makes no request to Vault, which is only traced
+	// when signing keys.
+	keySigningService, err = vault.New("user")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Vault client for key signing.  Error: %s", err)
+	}
+
+	return &certificateSigners{
+		privateKey: privateKey,
+		publicKey:  publicKey,
+		signers:    make(map[string]ssh.Signer),
+	}, nil
+}
+
+// loadHops reads the SSH key pair, creates the key signing service and returns
+// a function building the hops to traverse, including the jump hosts, to reach
+// the provided username@server argument.
+func loadHops(arg string) (tunnel.HopsFunc, error) {
+	signers, err := loadSigners()
+	if err != nil {
+		return nil, err
+	}
+
+	return signers.hopsFunc(arg)
+}
+
+// signer returns the signer authenticating the provided username, signing a
+// new certificate if none was signed yet or if it has expired.
+func (c *certificateSigners) signer(ctx context.Context, username string) (ssh.Signer, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	signer, ok := c.signers[username]
+	if ok && !tunnel.CertificateExpired(signer) {
+		return signer, nil
+	}
+
+	_, span := tracer.Start(ctx, "vault.sign_key", trace.String("principal", username))
+	started := time.Now()
+	certificate, err := keySigningService.SignKey(bytes.NewReader(c.publicKey), username)
+	recordSigning(started, err)
+	span.RecordError(err)
+	span.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign public key for %s.  Error: %s", username, err)
+	}
+
+	signer, err = tunnel.CreateSigner(bytes.NewReader(c.privateKey), certificate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create public key signer for %s.  Error: %s", username, err)
+	}
+
+	if validBefore, ok := tunnel.CertificateExpiry(signer); ok {
+		recordCertificate(username, validBefore)
+	}
+
+	c.signers[username] = signer
+	return signer, nil
+}
+
+// parseHops parses the jump hosts and the provided username@server argument
+// into the hops to traverse, without their signers.
+func parseHops(arg string) ([]tunnel.Hop, error) {
+	args := append(append([]string{}, jumpHostStrs...), arg)
+	hops := make([]tunnel.Hop, 0, len(args))
+
+	for _, arg := range args {
+		username, serverAddress, err := parseArg(arg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse server argument %s.  Error: %s", arg, err)
+		}
+
+		if !strings.Contains(serverAddress, ":") {
+			serverAddress = serverAddress + ":22"
+		}
+
+		hops = append(hops, tunnel.Hop{
+			Username: username,
+			Address:  serverAddress,
+		})
+	}
+
+	return hops, nil
+}
+
+// hopsFunc parses the jump hosts and the provided username@server argument and
+// returns a function building the list of hops from them.
+func (c *certificateSigners) hopsFunc(arg string) (tunnel.HopsFunc, error) {
+	hops, err := parseHops(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every call builds its own hops, as the tunnel may still be using those
+	// returned by a previous call while it reconnects.
+	return func(ctx context.Context) ([]tunnel.Hop, error) {
+		signed := make([]tunnel.Hop, 0, len(hops))
+		for _, hop := range hops {
+			signer, err := c.signer(ctx, hop.Username)
+			if err != nil {
+				return nil, err
+			}
+
+			hop.Signer = signer
+			signed = append(signed, hop)
+		}
+
+		return signed, nil
+	}, nil
+}
+
+// connect establishes an SSH connection with the provided username@server
+// argument, going through the jump hosts.
+func (c *certificateSigners) connect(arg string) (*ssh.Client, error) {
+	hopsFunc, err := c.hopsFunc(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	hops, err := hopsFunc(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return tunnel.Connect(hops)
+}
+
+// startTunnel starts a tunnel forwarding the local address, or the listener
+// when one was inherited, to the remote one through the server described by
+// the options, as returned by loadServer, logging its state transitions until
+// it shuts down.
+func startTunnel(ctx context.Context, options tunnel.Options, local net.Addr, listener net.Listener, remote net.Addr, tlsConfig *tls.Config) (*tunnel.Tunnel, error) {
+	access, err := parseAccess()
+	if err != nil {
+		return nil, err
+	}
+
+	options.Forwards = []tunnel.Forward{{
+		Local:          local,
+		Remote:         remote,
+		Listener:       listener,
+		MaxConnections: maxConnections,
+		RejectWhenFull: rejectWhenFull,
+		IdleTimeout:    idleTimeout,
+		MaxLifetime:    maxLifetime,
+		DialTimeout:    dialTimeout,
+		Access:         access,
+		TLS:            tlsConfig,
+		RateLimit:      forwardRateLimit,
+	}}
+	options.RateLimit = globalRateLimit
+	options.Keepalive = keepaliveInterval
+	options.Lazy = lazy
+	options.IdleDisconnect = idleDisconnect
+	options.CloseWhenIdle = exitWhenIdle
+	options.Logger = logger
+	options.Metrics = tunnelMetrics{}
+	options.Tracer = tracer
+
+	t, err := tunnel.New(options)
+	if errors.Is(err, tunnel.ErrExposed) {
+		return nil, fmt.Errorf("%w.  Anyone able to connect to %s:%s would get root-equivalent access to the server, use --allowPublicBind to do so anyway", err, local.Network(), local.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	go reportEvents(t.Events())
+
+	err = t.Start(ctx)
+	if errors.Is(err, tunnel.ErrRemoteUnreachable) {
+		return nil, fmt.Errorf("%w.  Check that %s:%s exists on the server and that the user is allowed to use it", err, remote.Network(), remote.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func reportEvents(events <-chan tunnel.Event) {
+	for event := range events {
+		if event.Err != nil {
+			logger.Info("tunnel state changed", "state", event.State.String(), "error", event.Err)
+			continue
+		}
+
+		logger.Info("tunnel state changed", "state", event.State.String())
+	}
+}
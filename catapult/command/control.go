@@ -0,0 +1,413 @@
+package command
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/marcboudreau/go-devops-talk/catapult/control"
+	"github.com/marcboudreau/go-devops-talk/catapult/tunnel"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// controlStartTimeout bounds the time given to a control master started in
+// the background to sign the key and connect to the server.
+const controlStartTimeout = time.Minute
+
+var controlPath string
+
+var noControl bool
+
+var controlCmd = &cobra.Command{
+	Use:   "control",
+	Short: "Manages control masters sharing a connection to a server.",
+	Long: `A control master is a background catapult process holding an authenticated SSH
+connection to a server and serving it on a control socket.  While one runs for a
+server, the tunnels established to that server by other catapult invocations open
+their connections through it, sparing them the key signing round-trip and the SSH
+handshake.  Use --noControl to connect directly anyway.
+
+The control socket of a server is found in $XDG_RUNTIME_DIR/catapult, or in a
+per-user directory of the temporary directory, unless --controlPath is provided.
+Its directory must be owned by the current user and accessible by them only, and
+a control master running as another user is never used.`,
+}
+
+var controlStartCmd = &cobra.Command{
+	Use:   "start username@server",
+	Short: "Starts a control master for the specified server in the background.",
+	Args:  cobra.ExactArgs(1),
+	// The metrics server and tracing are set up by the control master itself,
+	// which receives the same flags.
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return setupLogger()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		exitCode = runControlStart(cmd, args[0])
+	},
+}
+
+var controlServeCmd = &cobra.Command{
+	Use:   "serve username@server",
+	Short: "Runs a control master for the specified server in the foreground.",
+	Long: `Serve runs a control master for the specified server until it is stopped with
+"catapult control stop" or a SIGINT or SIGTERM signal, which makes it suitable to
+run as a service.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitCode = runControlServe(args[0])
+	},
+}
+
+var controlStatusCmd = &cobra.Command{
+	Use:   "status username@server",
+	Short: "Reports the status of the control master for the specified server.",
+	Args:  cobra.RangeArgs(0, 1),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitCode = runControlStatus(args)
+	},
+}
+
+var controlStopCmd = &cobra.Command{
+	Use:   "stop username@server",
+	Short: "Stops the control master for the specified server.",
+	Args:  cobra.RangeArgs(0, 1),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitCode = runControlStop(args)
+	},
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&controlPath, "controlPath", "", "Control socket of the control master for the server.  By default, it is derived from the server and jump hosts.")
+	rootCmd.PersistentFlags().BoolVar(&noControl, "noControl", false, "Connect to the server directly even if a control master runs for it.")
+
+	for _, cmd := range []*cobra.Command{controlStartCmd, controlServeCmd} {
+		cmd.Flags().DurationVar(&dialTimeout, "dialTimeout", 30*time.Second, "Time given to connect to the requested address for each connection opened through the control master.  0 means no limit.")
+	}
+
+	controlCmd.AddCommand(controlStartCmd, controlServeCmd, controlStatusCmd, controlStopCmd)
+	rootCmd.AddCommand(controlCmd)
+}
+
+// controlSocketPath returns the path of the control socket of the control
+// master for the provided username@server argument and the jump hosts.
+func controlSocketPath(arg string) (string, error) {
+	if controlPath != "" {
+		return controlPath, nil
+	}
+
+	hops, err := parseHops(arg)
+	if err != nil {
+		return "", err
+	}
+
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir != "" {
+		dir = filepath.Join(dir, "catapult")
+	} else {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("catapult-%d", os.Getuid()))
+	}
+
+	// The destination is hashed to keep the path within the length allowed
+	// for Unix domain sockets.
+	sum := sha256.Sum256([]byte(destination(hops)))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+".sock"), nil
+}
+
+// destination describes the hops as username@server:port values separated by
+// commas.
+func destination(hops []tunnel.Hop) string {
+	names := make([]string, len(hops))
+	for i, hop := range hops {
+		names[i] = hop.Username + "@" + hop.Address
+	}
+
+	return strings.Join(names, ",")
+}
+
+// loadServer returns the tunnel options reaching the provided username@server
+// argument: through the control master for it when one is running, or
+// directly with the hops built by loadHops.
+func loadServer(arg string) (tunnel.Options, error) {
+	if !noControl {
+		path, err := controlSocketPath(arg)
+		if err != nil {
+			return tunnel.Options{}, err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		status, err := control.NewClient(path).Status(ctx)
+		cancel()
+		if err == nil {
+			logger.Info("using control master", "path", path, "pid", status.PID, "destination", status.Destination)
+			return tunnel.Options{Dialer: control.NewClient(path)}, nil
+		}
+	}
+
+	hops, err := loadHops(arg)
+	if err != nil {
+		return tunnel.Options{}, err
+	}
+
+	return tunnel.Options{Hops: hops}, nil
+}
+
+// runControlServe runs a control master until it is stopped and returns the
+// exit code of the process.
+func runControlServe(arg string) int {
+	parsed, err := parseHops(arg)
+	if err != nil {
+		logger.Error("failed to parse server argument", "error", err)
+		return 1
+	}
+	dest := destination(parsed)
+
+	path, err := controlSocketPath(arg)
+	if err != nil {
+		logger.Error("failed to determine control socket", "error", err)
+		return 1
+	}
+
+	hops, err := loadHops(arg)
+	if err != nil {
+		logger.Error("failed to load keys", "error", err)
+		return 1
+	}
+
+	listener, err := control.Listen(path)
+	if err != nil {
+		logger.Error("failed to open control socket", "path", path, "error", err)
+		return 1
+	}
+	defer listener.Close()
+
+	t, err := tunnel.New(tunnel.Options{
+		Hops:      hops,
+		Keepalive: keepaliveInterval,
+		Logger:    logger,
+		Metrics:   tunnelMetrics{},
+		Tracer:    tracer,
+	})
+	if err != nil {
+		logger.Error("failed to create tunnel", "error", err)
+		return 1
+	}
+
+	var state atomic.Value
+	state.Store(tunnel.Connecting.String())
+	go func() {
+		for event := range t.Events() {
+			state.Store(event.State.String())
+			if event.Err != nil {
+				logger.Info("connection state changed", "state", event.State.String(), "error", event.Err)
+				continue
+			}
+			logger.Info("connection state changed", "state", event.State.String())
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := t.Start(ctx); err != nil {
+		logger.Error("failed to connect", "error", err)
+		return 1
+	}
+
+	server, err := control.NewServer(control.Options{
+		Dialer:      t,
+		Destination: dest,
+		State:       func() string { return state.Load().(string) },
+		DialTimeout: dialTimeout,
+		Logger:      logger,
+	})
+	if err != nil {
+		logger.Error("failed to create control server", "error", err)
+		t.Close()
+		return 1
+	}
+	go server.Serve(listener)
+	logger.Info("control master ready", "path", path, "destination", dest)
+
+	select {
+	case <-ctx.Done():
+	case <-server.Stopped():
+	}
+
+	server.Close()
+	if err := t.Close(); err != nil {
+		logger.Error("tunnel shut down with an error", "error", err)
+		return 1
+	}
+
+	return 0
+}
+
+// runControlStart starts a control master in the background, passing it the
+// flags set on the command line, and waits for it to be ready.
+func runControlStart(cmd *cobra.Command, arg string) int {
+	path, err := controlSocketPath(arg)
+	if err != nil {
+		logger.Error("failed to determine control socket", "error", err)
+		return 1
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		logger.Error("failed to locate catapult executable", "error", err)
+		return 1
+	}
+
+	args := []string{"control", "serve", "--controlPath", path}
+	cmd.Flags().Visit(func(flag *pflag.Flag) {
+		if flag.Name == "controlPath" {
+			return
+		}
+		value := flag.Value.String()
+		if strings.HasSuffix(flag.Value.Type(), "Slice") {
+			// Slice flags are formatted as [a,b] and parsed from a,b.
+			value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+		}
+		args = append(args, "--"+flag.Name+"="+value)
+	})
+	args = append(args, arg)
+
+	// The log is written next to the socket, so the directory is checked
+	// before it is opened, and a symbolic link planted in its place is
+	// refused.
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		logger.Error("failed to create control socket directory", "error", err)
+		return 1
+	}
+	if err := control.CheckDir(filepath.Dir(path)); err != nil {
+		logger.Error("refusing to use control socket directory", "error", err)
+		return 1
+	}
+	logFilename := strings.TrimSuffix(path, ".sock") + ".log"
+	logFile, err := os.OpenFile(logFilename, os.O_WRONLY|os.O_CREATE|os.O_APPEND|noFollow, 0600)
+	if err != nil {
+		logger.Error("failed to open control master log file", "path", logFilename, "error", err)
+		return 1
+	}
+	defer logFile.Close()
+
+	child := exec.Command(executable, args...)
+	child.Stdout = logFile
+	child.Stderr = logFile
+	child.SysProcAttr = detachedProcess()
+	if err := child.Start(); err != nil {
+		logger.Error("failed to start control master", "error", err)
+		return 1
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		child.Wait()
+		close(exited)
+	}()
+
+	client := control.NewClient(path)
+	deadline := time.After(controlStartTimeout)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		status, err := client.Status(ctx)
+		cancel()
+		if err == nil && status.PID == child.Process.Pid {
+			fmt.Printf("control master %d for %s listening on %s\n", status.PID, status.Destination, path)
+			return 0
+		}
+
+		select {
+		case <-exited:
+			logger.Error("control master exited before being ready", "log", logFilename)
+			return 1
+		case <-deadline:
+			logger.Error("control master did not get ready in time", "log", logFilename)
+			child.Process.Kill()
+			return 1
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// controlClient returns the client of the control master designated by the
+// optional username@server argument or --controlPath.
+func controlClient(args []string) (*control.Client, error) {
+	if len(args) == 0 {
+		if controlPath == "" {
+			return nil, fmt.Errorf("a server argument or --controlPath is required")
+		}
+		return control.NewClient(controlPath), nil
+	}
+
+	path, err := controlSocketPath(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return control.NewClient(path), nil
+}
+
+// runControlStatus prints the status of a control master and returns the exit
+// code of the process: 0 when it runs and 1 otherwise.
+func runControlStatus(args []string) int {
+	client, err := controlClient(args)
+	if err != nil {
+		logger.Error("failed to determine control socket", "error", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	status, err := client.Status(ctx)
+	if err != nil {
+		logger.Error("no control master is running", "path", client.Path, "error", err)
+		return 1
+	}
+
+	fmt.Printf("pid: %d\n", status.PID)
+	fmt.Printf("destination: %s\n", status.Destination)
+	fmt.Printf("state: %s\n", status.State)
+	fmt.Printf("started: %s\n", status.Started.Format(time.RFC3339))
+	fmt.Printf("active connections: %d\n", status.ActiveConnections)
+	fmt.Printf("total connections: %d\n", status.TotalConnections)
+
+	return 0
+}
+
+// runControlStop asks a control master to stop and waits for its control
+// socket to go away.
+func runControlStop(args []string) int {
+	client, err := controlClient(args)
+	if err != nil {
+		logger.Error("failed to determine control socket", "error", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Stop(ctx); err != nil {
+		logger.Error("failed to stop control master", "path", client.Path, "error", err)
+		return 1
+	}
+
+	for ctx.Err() == nil {
+		if _, err := os.Stat(client.Path); os.IsNotExist(err) {
+			return 0
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	logger.Warn("control master is still shutting down", "path", client.Path)
+	return 0
+}
@@ -0,0 +1,406 @@
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/marcboudreau/go-devops-talk/catapult/sftp"
+	"github.com/spf13/cobra"
+)
+
+var cpRecursive bool
+
+var cpPreserve bool
+
+var cpProgress bool
+
+var cpResume bool
+
+var cpCmd = &cobra.Command{
+	Use:   "cp source destination",
+	Short: "Copies files to or from a server over SFTP.",
+	Long: `Cp copies files between the local host and a server, using SFTP over the same signed
+certificate connection as the other commands.  Remote files are designated as
+username@server:path, where a relative path is relative to the user's home directory.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		exitCode = runCp(cmd, args)
+	},
+}
+
+func init() {
+	cpCmd.Flags().BoolVarP(&cpRecursive, "recursive", "R", false, "Copy directories recursively.")
+	cpCmd.Flags().BoolVar(&cpPreserve, "preserve", false, "Preserve the permissions and modification times of the copied files.")
+	cpCmd.Flags().BoolVar(&cpProgress, "progress", false, "Report the progress of each file transfer on stderr.")
+	cpCmd.Flags().BoolVar(&cpResume, "resume", false, "Resume the transfer of files partially copied by a previous invocation, instead of copying them again.")
+
+	rootCmd.AddCommand(cpCmd)
+}
+
+// fileSystem abstracts the local and remote file systems files are copied
+// between.
+type fileSystem interface {
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	Mkdir(name string, perm os.FileMode) error
+	Chmod(name string, mode os.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Open(name string) (io.ReadSeeker, io.Closer, error)
+	OpenFile(name string, flag int, perm os.FileMode) (io.WriteSeeker, io.Closer, error)
+	Join(elem ...string) string
+	Base(name string) string
+}
+
+type localFileSystem struct{}
+
+func (localFileSystem) Stat(name string) (os.FileInfo, error)     { return os.Stat(name) }
+func (localFileSystem) Mkdir(name string, perm os.FileMode) error { return os.Mkdir(name, perm) }
+func (localFileSystem) Chmod(name string, mode os.FileMode) error { return os.Chmod(name, mode) }
+func (localFileSystem) Join(elem ...string) string                { return filepath.Join(elem...) }
+func (localFileSystem) Base(name string) string                   { return filepath.Base(name) }
+
+func (localFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	dir, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	return dir.Readdir(0)
+}
+
+func (localFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (localFileSystem) Open(name string) (io.ReadSeeker, io.Closer, error) {
+	file, err := os.Open(name)
+	return file, file, err
+}
+
+func (localFileSystem) OpenFile(name string, flag int, perm os.FileMode) (io.WriteSeeker, io.Closer, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	return file, file, err
+}
+
+type remoteFileSystem struct {
+	*sftp.Client
+}
+
+func (remoteFileSystem) Join(elem ...string) string { return path.Join(elem...) }
+func (remoteFileSystem) Base(name string) string    { return path.Base(name) }
+
+func (r remoteFileSystem) Open(name string) (io.ReadSeeker, io.Closer, error) {
+	file, err := r.Client.Open(name)
+	return file, file, err
+}
+
+func (r remoteFileSystem) OpenFile(name string, flag int, perm os.FileMode) (io.WriteSeeker, io.Closer, error) {
+	file, err := r.Client.OpenFile(name, flag, perm)
+	return file, file, err
+}
+
+// parseCopyArg splits a username@server:path argument into its server and path
+// parts.  Arguments that designate local paths have an empty server part.
+func parseCopyArg(arg string) (server, name string) {
+	pos := strings.Index(arg, ":")
+	if pos <= 0 || strings.ContainsAny(arg[:pos], "/\\") {
+		return "", arg
+	}
+
+	name = arg[pos+1:]
+	if name == "" {
+		name = "."
+	}
+
+	return arg[:pos], name
+}
+
+func runCp(cmd *cobra.Command, args []string) int {
+	if len(args) != 2 {
+		logger.Error("a source and a destination argument are required")
+		fmt.Fprintln(os.Stderr, cmd.UsageString())
+		return 1
+	}
+
+	srcServer, src := parseCopyArg(args[0])
+	dstServer, dst := parseCopyArg(args[1])
+	if srcServer == "" && dstServer == "" {
+		logger.Error("either the source or the destination must be a username@server:path argument")
+		return 1
+	}
+
+	signers, err := loadSigners()
+	if err != nil {
+		logger.Error("failed to load keys", "error", err)
+		return 1
+	}
+
+	srcFS, closeSrc, err := openFileSystem(signers, srcServer)
+	if err != nil {
+		logger.Error("failed to open source", "server", srcServer, "error", err)
+		return 1
+	}
+	defer closeSrc()
+
+	dstFS, closeDst, err := openFileSystem(signers, dstServer)
+	if err != nil {
+		logger.Error("failed to open destination", "server", dstServer, "error", err)
+		return 1
+	}
+	defer closeDst()
+
+	// Like cp, copying to an existing directory copies into it.
+	if info, err := dstFS.Stat(dst); err == nil && info.IsDir() {
+		dst = dstFS.Join(dst, srcFS.Base(src))
+	}
+
+	if err := copyPath(srcFS, src, dstFS, dst); err != nil {
+		logger.Error("failed to copy", "source", args[0], "destination", args[1], "error", err)
+		return 1
+	}
+
+	return 0
+}
+
+// openFileSystem returns the local file system when no server is provided, or
+// an SFTP client connected to the server otherwise.
+func openFileSystem(signers *certificateSigners, server string) (fileSystem, func(), error) {
+	if server == "" {
+		return localFileSystem{}, func() {}, nil
+	}
+
+	client, err := signers.connect(server)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, nil, fmt.Errorf("failed to start SFTP session with %s.  Error: %s", server, err)
+	}
+
+	return remoteFileSystem{sftpClient}, func() {
+		sftpClient.Close()
+		client.Close()
+	}, nil
+}
+
+// copyPath copies the src file, or directory when copying recursively, to dst.
+func copyPath(srcFS fileSystem, src string, dstFS fileSystem, dst string) error {
+	info, err := srcFS.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		if !cpRecursive {
+			return fmt.Errorf("%s is a directory, use --recursive to copy it", src)
+		}
+
+		if err := dstFS.Mkdir(dst, info.Mode().Perm()|0700); err != nil {
+			if existing, statErr := dstFS.Stat(dst); statErr != nil || !existing.IsDir() {
+				return err
+			}
+		}
+
+		entries, err := srcFS.ReadDir(src)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if !entry.Mode().IsDir() && !entry.Mode().IsRegular() {
+				logger.Warn("skipping file that is not a regular file or directory", "file", srcFS.Join(src, entry.Name()))
+				continue
+			}
+
+			if err := copyPath(srcFS, srcFS.Join(src, entry.Name()), dstFS, dstFS.Join(dst, entry.Name())); err != nil {
+				return err
+			}
+		}
+	} else if err := copyFile(srcFS, src, info, dstFS, dst); err != nil {
+		return err
+	}
+
+	if cpPreserve {
+		if err := dstFS.Chmod(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+
+		if err := dstFS.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resumeCheckLength is the number of bytes at the end of a partially copied
+// file compared with the source before resuming its transfer.
+const resumeCheckLength = 32 * 1024
+
+// copyFile copies the content of the src file to dst.  When resuming, the data
+// already present in a dst file that looks like a partial copy of src is kept
+// and only the rest is copied.
+func copyFile(srcFS fileSystem, src string, info os.FileInfo, dstFS fileSystem, dst string) error {
+	var offset int64
+	if cpResume {
+		offset = resumeOffset(srcFS, src, info, dstFS, dst)
+	}
+
+	reader, srcCloser, err := srcFS.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcCloser.Close()
+
+	flag := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+
+	writer, dstCloser, err := dstFS.OpenFile(dst, flag, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if offset > 0 {
+		if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+			dstCloser.Close()
+			return err
+		}
+
+		if _, err := writer.Seek(offset, io.SeekStart); err != nil {
+			dstCloser.Close()
+			return err
+		}
+	}
+
+	var progress *progressWriter
+	var w io.Writer = writer
+	if cpProgress {
+		progress = newProgressWriter(writer, dst, offset, info.Size())
+		w = progress
+	}
+
+	// The large buffer keeps many SFTP requests in flight.  Both ends are
+	// wrapped so that io.CopyBuffer uses it rather than ReadFrom or WriteTo.
+	_, err = io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{reader}, make([]byte, 1024*1024))
+	if progress != nil {
+		progress.Done()
+	}
+	if err != nil {
+		dstCloser.Close()
+		return fmt.Errorf("failed to copy %s to %s.  Error: %s", src, dst, err)
+	}
+
+	return dstCloser.Close()
+}
+
+// resumeOffset returns the size of the dst file if it looks like a partial
+// copy of src: it is not larger than src, it was not modified before src, and
+// its last bytes match those of src at the same offset.  Otherwise, it returns
+// 0 so that the file is copied again.
+func resumeOffset(srcFS fileSystem, src string, info os.FileInfo, dstFS fileSystem, dst string) int64 {
+	existing, err := dstFS.Stat(dst)
+	if err != nil || !existing.Mode().IsRegular() || existing.Size() == 0 {
+		return 0
+	}
+
+	if existing.Size() > info.Size() || existing.ModTime().Before(info.ModTime()) {
+		logger.Warn("destination does not look like a partial copy of the source, copying it again", "source", src, "destination", dst)
+		return 0
+	}
+
+	length := existing.Size()
+	if length > resumeCheckLength {
+		length = resumeCheckLength
+	}
+
+	srcTail, srcErr := readTail(srcFS, src, existing.Size()-length, length)
+	dstTail, dstErr := readTail(dstFS, dst, existing.Size()-length, length)
+	if srcErr != nil || dstErr != nil || !bytes.Equal(srcTail, dstTail) {
+		logger.Warn("destination does not match the beginning of the source, copying it again", "source", src, "destination", dst)
+		return 0
+	}
+
+	return existing.Size()
+}
+
+// readTail reads length bytes of the named file starting at offset.
+func readTail(fs fileSystem, name string, offset, length int64) ([]byte, error) {
+	reader, closer, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// progressWriter reports on stderr how much of a file has been written.
+type progressWriter struct {
+	writer   io.Writer
+	name     string
+	initial  int64
+	written  int64
+	total    int64
+	started  time.Time
+	reported time.Time
+}
+
+func newProgressWriter(writer io.Writer, name string, written, total int64) *progressWriter {
+	return &progressWriter{
+		writer:  writer,
+		name:    name,
+		initial: written,
+		written: written,
+		total:   total,
+		started: time.Now(),
+	}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.writer.Write(b)
+	p.written += int64(n)
+
+	if time.Since(p.reported) >= 200*time.Millisecond {
+		p.report()
+	}
+
+	return n, err
+}
+
+// Done reports the final progress and ends the progress line.
+func (p *progressWriter) Done() {
+	p.report()
+	fmt.Fprintln(os.Stderr)
+}
+
+func (p *progressWriter) report() {
+	p.reported = time.Now()
+
+	percent := 100
+	if p.total > 0 {
+		percent = int(p.written * 100 / p.total)
+	}
+
+	rate := float64(p.written-p.initial) / time.Since(p.started).Seconds() / 1024
+	fmt.Fprintf(os.Stderr, "\r%s  %3d%%  %d/%d bytes  %.1f KiB/s", p.name, percent, p.written, p.total, rate)
+}
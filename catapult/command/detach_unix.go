@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package command
+
+import "syscall"
+
+// noFollow makes opening a file fail when its path is a symbolic link.
+const noFollow = syscall.O_NOFOLLOW
+
+// detachedProcess returns the attributes starting a process in a session of
+// its own, so that it outlives the terminal it was started from.
+func detachedProcess() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
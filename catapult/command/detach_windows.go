@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package command
+
+import "syscall"
+
+// noFollow is zero as symbolic links are not planted in the directories of
+// other users on Windows, which are private by default.
+const noFollow = 0
+
+// detachedProcess returns the attributes starting a process in a process
+// group of its own, so that it outlives the console it was started from.
+func detachedProcess() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
@@ -0,0 +1,249 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var execLocalAddressStr string
+
+var execRemoteAddressStr string
+
+var execDrainTimeout time.Duration
+
+var execEnvStrs []string
+
+var execCmd = &cobra.Command{
+	Use:   "exec username@server -- command [args...]",
+	Short: "Runs a command while a tunnel to the specified server is established.",
+	Long: `Exec establishes a tunnel to the specified server on an ephemeral local port, runs
+the given command with environment variables describing the local end of the tunnel,
+and tears the tunnel down once the command exits.  Signals received by catapult are
+forwarded to the command, and catapult exits with the command's exit code.
+
+The values of the environment variables are templates that can refer to the following
+fields: {{.LocalNetwork}}, {{.LocalAddr}}, {{.RemoteNetwork}}, {{.RemoteAddr}} and
+{{.CertPath}}, the directory holding the TLS client material when --tls is used.  Unless
+--env is provided, DOCKER_TLS_VERIFY and DOCKER_CERT_PATH are also set in that case.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		exitCode = runExec(cmd, args)
+	},
+}
+
+func init() {
+	execCmd.Flags().StringVarP(&execLocalAddressStr, "localAddress", "l", "tcp:127.0.0.1:0", "Network address of local port of the tunnel to establish.")
+	execCmd.Flags().StringVarP(&execRemoteAddressStr, "remoteAddress", "r", "unix:/var/run/docker.sock", "Network address of remote port of the tunnel to establish.")
+	execCmd.Flags().DurationVar(&execDrainTimeout, "drainTimeout", 10*time.Second, "Time given to active connections to finish once the command exits, before they are cut.")
+	addForwardFlags(execCmd.Flags())
+	execCmd.Flags().StringArrayVarP(&execEnvStrs, "env", "e", []string{"DOCKER_HOST={{.LocalNetwork}}://{{.LocalAddr}}"}, "Environment variable (NAME=template) to set for the command.  Repeat to set several variables.")
+
+	rootCmd.AddCommand(execCmd)
+}
+
+// envData holds the fields available to the environment variable templates.
+type envData struct {
+	LocalNetwork  string
+	LocalAddr     string
+	RemoteNetwork string
+	RemoteAddr    string
+	CertPath      string
+}
+
+// runExec runs the command while the tunnel is established and returns the
+// exit code of the command, or 1 when the tunnel could not be established.
+func runExec(cmd *cobra.Command, args []string) int {
+	command := args
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		command = args[dash:]
+		args = args[:dash]
+	} else if len(args) > 0 {
+		command = args[1:]
+		args = args[:1]
+	}
+
+	if len(args) != 1 || len(command) == 0 {
+		logger.Error("a server argument and a command are required")
+		fmt.Fprintln(os.Stderr, cmd.UsageString())
+		return 1
+	}
+
+	tlsConfig, certPath, cleanup, err := setupTLS()
+	if err != nil {
+		logger.Error("failed to set up TLS", "error", err)
+		return 1
+	}
+	defer cleanup()
+
+	envStrs := execEnvStrs
+	if certPath != "" && !cmd.Flags().Changed("env") {
+		envStrs = append(envStrs, "DOCKER_TLS_VERIFY=1", "DOCKER_CERT_PATH={{.CertPath}}")
+	}
+
+	templates, err := parseEnvTemplates(envStrs)
+	if err != nil {
+		logger.Error("failed to parse environment templates", "error", err)
+		return 1
+	}
+
+	options, err := loadServer(args[0])
+	if err != nil {
+		logger.Error("failed to load keys", "error", err)
+		return 1
+	}
+	options.DrainTimeout = execDrainTimeout
+
+	if err := setupRateLimits(); err != nil {
+		logger.Error("failed to set up rate limits", "error", err)
+		return 1
+	}
+	defer logThrottled()
+
+	options.Capture, err = setupCapture()
+	if err != nil {
+		logger.Error("failed to set up capture", "error", err)
+		return 1
+	}
+	if options.Capture != nil {
+		defer options.Capture.Close()
+	}
+
+	local, err := parseAddress(execLocalAddressStr)
+	if err != nil {
+		logger.Error("failed to parse local address", "address", execLocalAddressStr, "error", err)
+		return 1
+	}
+
+	remote, err := parseAddress(execRemoteAddressStr)
+	if err != nil {
+		logger.Error("failed to parse remote address", "address", execRemoteAddressStr, "error", err)
+		return 1
+	}
+
+	t, err := startTunnel(context.Background(), options, local, nil, remote, tlsConfig)
+	if err != nil {
+		logger.Error("failed to establish tunnel", "error", err)
+		return 1
+	}
+
+	addr := t.Addr()
+	env, err := renderEnv(templates, envData{
+		LocalNetwork:  addr.Network(),
+		LocalAddr:     addr.String(),
+		RemoteNetwork: remote.Network(),
+		RemoteAddr:    remote.String(),
+		CertPath:      certPath,
+	})
+	if err != nil {
+		logger.Error("failed to render environment", "error", err)
+		t.Close()
+		return 1
+	}
+
+	code := runChild(command, env)
+
+	if err := t.Close(); err != nil {
+		logger.Error("tunnel shut down with an error", "error", err)
+	}
+
+	return code
+}
+
+// parseEnvTemplates parses NAME=template strings into templates named after
+// the environment variable they produce.
+func parseEnvTemplates(envStrs []string) ([]*template.Template, error) {
+	templates := make([]*template.Template, 0, len(envStrs))
+
+	for _, envStr := range envStrs {
+		pos := strings.Index(envStr, "=")
+		if pos <= 0 {
+			return nil, fmt.Errorf("environment variable %s must be of the form NAME=template", envStr)
+		}
+
+		t, err := template.New(envStr[:pos]).Option("missingkey=error").Parse(envStr[pos+1:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template of environment variable %s.  Error: %s", envStr[:pos], err)
+		}
+
+		templates = append(templates, t)
+	}
+
+	return templates, nil
+}
+
+// renderEnv returns the environment of the current process extended with the
+// variables produced by the provided templates.
+func renderEnv(templates []*template.Template, data envData) ([]string, error) {
+	env := os.Environ()
+
+	for _, t := range templates {
+		var value bytes.Buffer
+		if err := t.Execute(&value, data); err != nil {
+			return nil, fmt.Errorf("failed to render environment variable %s.  Error: %s", t.Name(), err)
+		}
+
+		env = append(env, t.Name()+"="+value.String())
+	}
+
+	return env, nil
+}
+
+// runChild runs the provided command with the given environment, forwarding
+// the signals catapult receives to it, and returns its exit code.  Following
+// shell conventions, a command killed by a signal yields 128 plus the signal
+// number.
+func runChild(command, env []string) int {
+	child := exec.Command(command[0], command[1:]...)
+	child.Env = env
+	child.Stdin = os.Stdin
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+
+	if err := child.Start(); err != nil {
+		logger.Error("failed to start command", "command", command[0], "error", err)
+		return 127
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				child.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := child.Wait()
+	close(done)
+
+	if err == nil {
+		return 0
+	}
+
+	if status, ok := child.ProcessState.Sys().(syscall.WaitStatus); ok {
+		if status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+
+		return status.ExitStatus()
+	}
+
+	logger.Error("failed to run command", "command", command[0], "error", err)
+	return 1
+}
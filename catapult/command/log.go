@@ -0,0 +1,42 @@
+package command
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+var logLevelStr string
+
+var logFormat string
+
+// logger records the activity of the commands.  It writes text records to
+// stderr until the logLevel and logFormat flags are applied by setupLogger.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&logLevelStr, "logLevel", "info", "Minimum level of the log records written to stderr: debug, info, warn or error.")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "logFormat", "text", "Format of the log records written to stderr: text or json.")
+}
+
+// setupLogger replaces the logger with one honouring the logLevel and
+// logFormat flags.
+func setupLogger() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevelStr)); err != nil {
+		return fmt.Errorf("invalid log level %s", logLevelStr)
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+
+	switch logFormat {
+	case "text":
+		logger = slog.New(slog.NewTextHandler(os.Stderr, options))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, options))
+	default:
+		return fmt.Errorf("invalid log format %s, expected text or json", logFormat)
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package command
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/marcboudreau/go-devops-talk/catapult/metrics"
+	"github.com/marcboudreau/go-devops-talk/catapult/tunnel"
+)
+
+var metricsAddressStr string
+
+var registry = metrics.NewRegistry()
+
+var (
+	signRequests = registry.NewCounter("catapult_sign_requests_total",
+		"Requests made to the key signing service, by result.", "result")
+	signDuration = registry.NewHistogram("catapult_sign_duration_seconds",
+		"Time taken by the key signing service to sign the public key.", metrics.DefaultBuckets)
+	certificateTTL = registry.NewGauge("catapult_certificate_expiry_seconds",
+		"Time left before the last certificate signed for each principal expires.", "principal")
+	tunnelState = registry.NewGauge("catapult_tunnel_state",
+		"Whether the tunnel is in each state, 1 for the current state and 0 for the others.", "state")
+	reconnects = registry.NewCounter("catapult_ssh_reconnects_total",
+		"Times the SSH connection was lost and had to be re-established.")
+	forwardedConnections = registry.NewCounter("catapult_forward_connections_total",
+		"Connections accepted on the local end of each forward and not rejected, whether or not its remote end could then be reached.", "local", "remote")
+	rejectedConnections = registry.NewCounter("catapult_forward_connection_rejections_total",
+		"Accepted connections closed because the forward had too many active connections or the peer was not allowed to use it.", "local", "remote")
+	failedConnections = registry.NewCounter("catapult_forward_connection_failures_total",
+		"Accepted connections for which the remote end of the forward could not be reached.", "local", "remote")
+	activeConnections = registry.NewGauge("catapult_forward_active_connections",
+		"Connections currently being forwarded.", "local", "remote")
+	forwardedBytes = registry.NewCounter("catapult_forward_bytes_total",
+		"Bytes forwarded, sent towards the remote end or received from it.", "local", "remote", "direction")
+)
+
+// certificateExpiries records when the last certificate signed for each
+// principal expires, from which certificateTTL is computed on every scrape.
+var certificateExpiries = struct {
+	sync.Mutex
+	validBefore map[string]time.Time
+}{validBefore: make(map[string]time.Time)}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&metricsAddressStr, "metricsAddress", "", "Network address (host:port) on which Prometheus metrics are served under /metrics.  Metrics are not served when empty.")
+
+	registry.OnCollect(func() {
+		certificateExpiries.Lock()
+		defer certificateExpiries.Unlock()
+
+		for principal, validBefore := range certificateExpiries.validBefore {
+			certificateTTL.Set(time.Until(validBefore).Seconds(), principal)
+		}
+	})
+}
+
+// startMetricsServer serves the metrics on the address provided with the
+// metricsAddress flag, if any, for the lifetime of the process.
+func startMetricsServer() error {
+	if metricsAddressStr == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", metricsAddressStr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			logger.Warn("metrics server stopped", "error", err)
+		}
+	}()
+
+	logger.Info("serving metrics", "address", listener.Addr().String())
+	return nil
+}
+
+// recordSigning records the outcome of a request to the key signing service.
+func recordSigning(started time.Time, err error) {
+	signDuration.Observe(time.Since(started).Seconds())
+
+	if err != nil {
+		signRequests.Inc("failure")
+		return
+	}
+
+	signRequests.Inc("success")
+}
+
+// recordCertificate records the expiry of the certificate signed for the
+// principal.
+func recordCertificate(principal string, validBefore time.Time) {
+	certificateExpiries.Lock()
+	defer certificateExpiries.Unlock()
+
+	certificateExpiries.validBefore[principal] = validBefore
+}
+
+// tunnelMetrics records the activity of tunnels in the registry.
+type tunnelMetrics struct{}
+
+func (tunnelMetrics) StateChanged(state tunnel.State) {
+	for _, s := range []tunnel.State{tunnel.Connecting, tunnel.Connected, tunnel.Ready, tunnel.Disconnected, tunnel.Closed, tunnel.Idle} {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		tunnelState.Set(value, s.String())
+	}
+
+	if state == tunnel.Disconnected {
+		reconnects.Inc()
+	}
+}
+
+func (tunnelMetrics) ConnectionOpened(forward tunnel.Forward) {
+	forwardedConnections.Inc(forwardLabels(forward)...)
+	activeConnections.Inc(forwardLabels(forward)...)
+}
+
+func (tunnelMetrics) ConnectionRejected(forward tunnel.Forward) {
+	rejectedConnections.Inc(forwardLabels(forward)...)
+}
+
+func (tunnelMetrics) ConnectionFailed(forward tunnel.Forward) {
+	failedConnections.Inc(forwardLabels(forward)...)
+}
+
+func (tunnelMetrics) ConnectionClosed(forward tunnel.Forward) {
+	activeConnections.Dec(forwardLabels(forward)...)
+}
+
+func (tunnelMetrics) BytesSent(forward tunnel.Forward, n int64) {
+	forwardedBytes.Add(float64(n), append(forwardLabels(forward), "sent")...)
+}
+
+func (tunnelMetrics) BytesReceived(forward tunnel.Forward, n int64) {
+	forwardedBytes.Add(float64(n), append(forwardLabels(forward), "received")...)
+}
+
+func forwardLabels(forward tunnel.Forward) []string {
+	return []string{
+		forward.Local.Network() + ":" + forward.Local.String(),
+		forward.Remote.Network() + ":" + forward.Remote.String(),
+	}
+}
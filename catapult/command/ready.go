@@ -0,0 +1,133 @@
+package command
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+var readyFilename string
+
+var pidFilename string
+
+var readyFd int
+
+var addressFilename string
+
+func init() {
+	rootCmd.Flags().StringVar(&readyFilename, "readyFile", "", "File in which the address of the local end of the tunnel is written once the tunnel is ready.  It is removed on exit.")
+	rootCmd.Flags().StringVar(&pidFilename, "pidFile", "", "File in which the process ID is written once the tunnel is ready.  It is removed on exit.")
+	rootCmd.Flags().StringVar(&addressFilename, "addressFile", "", "File in which the address of the local end of the tunnel is written, as a URL such as tcp://127.0.0.1:34567 suitable for DOCKER_HOST, once the tunnel is ready.  It is removed on exit.")
+	rootCmd.Flags().IntVar(&readyFd, "readyFd", -1, "File descriptor, inherited from the parent process, on which the ready line is written and which is then closed once the tunnel is ready.")
+}
+
+// readyLine returns the machine readable line announcing that the tunnel is
+// ready to accept connections on the provided address.
+func readyLine(addr net.Addr) string {
+	return fmt.Sprintf("ready %s:%s\n", addr.Network(), addr.String())
+}
+
+// addressURL returns the address as a URL such as tcp://127.0.0.1:2375 or
+// unix:///tmp/catapult123/tunnel.sock.
+func addressURL(addr net.Addr) string {
+	return fmt.Sprintf("%s://%s", addr.Network(), addr.String())
+}
+
+// signalReady announces that the tunnel is ready to accept connections on the
+// provided address on stdout and through every notification mechanism that
+// was requested.
+func signalReady(addr net.Addr) {
+	line := readyLine(addr)
+
+	fmt.Print(line)
+
+	if readyFilename != "" {
+		if err := writeFileAtomically(readyFilename, line); err != nil {
+			logger.Warn("failed to write ready file", "path", readyFilename, "error", err)
+		}
+	}
+
+	if addressFilename != "" {
+		if err := writeFileAtomically(addressFilename, addressURL(addr)+"\n"); err != nil {
+			logger.Warn("failed to write address file", "path", addressFilename, "error", err)
+		}
+	}
+
+	if pidFilename != "" {
+		if err := writeFileAtomically(pidFilename, fmt.Sprintf("%d\n", os.Getpid())); err != nil {
+			logger.Warn("failed to write PID file", "path", pidFilename, "error", err)
+		}
+	}
+
+	if readyFd >= 0 {
+		file := os.NewFile(uintptr(readyFd), "ready")
+		if _, err := file.WriteString(line); err != nil {
+			logger.Warn("failed to write to ready file descriptor", "fd", readyFd, "error", err)
+		}
+		file.Close()
+	}
+
+	if err := notifySystemd(fmt.Sprintf("READY=1\nMAINPID=%d\nSTATUS=Forwarding %s:%s", os.Getpid(), addr.Network(), addr.String())); err != nil {
+		logger.Warn("failed to notify systemd", "error", err)
+	}
+}
+
+// removeReadyFiles removes the ready and PID files written by signalReady.
+func removeReadyFiles() {
+	for _, filename := range []string{readyFilename, addressFilename, pidFilename} {
+		if filename == "" {
+			continue
+		}
+
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			logger.Warn("failed to remove file", "path", filename, "error", err)
+		}
+	}
+}
+
+// notifySystemd sends the provided state to the systemd notification socket
+// named by the NOTIFY_SOCKET environment variable, when it is set.
+func notifySystemd(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// writeFileAtomically writes the provided content to a temporary file that is
+// then renamed, so that readers never observe a partially written file.
+func writeFileAtomically(filename, content string) error {
+	file, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), filename)
+}
@@ -1,18 +1,21 @@
 package command
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
 	"os/user"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/marcboudreau/go-devops-talk/catapult/tunnel"
-
-	"github.com/marcboudreau/go-devops-talk/catapult"
-	"github.com/marcboudreau/go-devops-talk/catapult/vault"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var privateKeyFilename string
@@ -23,7 +26,41 @@ var localAddressStr string
 
 var remoteAddressStr string
 
-var keySigningService catapult.KeySigningService
+var jumpHostStrs []string
+
+var keepaliveInterval time.Duration
+
+var drainTimeout time.Duration
+
+var lazy bool
+
+var idleDisconnect time.Duration
+
+var exitWhenIdle bool
+
+var maxConnections int
+
+var rejectWhenFull bool
+
+var idleTimeout time.Duration
+
+var maxLifetime time.Duration
+
+var dialTimeout time.Duration
+
+var allowedSourceStrs []string
+
+var allowedUserStrs []string
+
+var socketModeStr string
+
+var socketOwner string
+
+var socketGroup string
+
+var allowPublicBind bool
+
+var exitCode int
 
 var rootCmd = &cobra.Command{
 	Use:   "catapult username@server",
@@ -32,94 +69,235 @@ var rootCmd = &cobra.Command{
 It then uses that signed public key (certificate) to connect with the specified server.
 Once connected, it establishes a tunnel by opening a local port and forwarding all data
 it receives to the specified remote port, and vice-versa.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) < 1 {
-			fmt.Fprintln(os.Stderr, "Error: missing argument")
-			fmt.Fprintln(os.Stderr, cmd.UsageString())
-			return
+	Args: cobra.ArbitraryArgs,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := setupLogger(); err != nil {
+			return err
 		}
 
-		if len(args) > 1 {
-			fmt.Fprintln(os.Stderr, "Warning: extra arguments will be ignored")
+		if err := setupTracing(); err != nil {
+			return err
 		}
 
-		username, serverAddress, err := parseArg(args[0])
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to parse command argument %s.  Error: %s\n", args[0], err)
-			return
-		}
+		return startMetricsServer()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		exitCode = runTunnel(cmd, args)
+	},
+}
 
-		publicKey, err := os.Open(publicKeyFilename)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to open public key file %s.  Error: %s\n", publicKeyFilename, err)
-			return
-		}
-		defer publicKey.Close()
+func init() {
+	rootCmd.PersistentFlags().StringVarP(&privateKeyFilename, "privateKey", "k", "", "File containing the private SSH key used to connect to the server.")
+	rootCmd.PersistentFlags().StringVarP(&publicKeyFilename, "publicKey", "p", "", "File containing the public SSH key to sign.")
+	rootCmd.Flags().StringVarP(&localAddressStr, "localAddress", "l", "", "Network address of local port of the tunnel to establish.  Use port 0, as in tcp:127.0.0.1:0, to bind an ephemeral port, or unix: without a path to use a socket in a private temporary directory.  The bound address is reported on stdout once the tunnel is ready.  Use systemd:NAME to serve the socket passed by systemd socket activation with that FileDescriptorName, or systemd: when a single socket is passed.")
+	rootCmd.Flags().StringVarP(&remoteAddressStr, "remoteAddress", "r", "", "Network address of remote port of the tunnel to establish.")
+	rootCmd.PersistentFlags().StringSliceVarP(&jumpHostStrs, "jump", "J", nil, "Jump host (username@server) to connect through before reaching the server.  Repeat or separate with commas to traverse several jump hosts in order.")
+	rootCmd.PersistentFlags().DurationVar(&keepaliveInterval, "keepalive", 15*time.Second, "Interval between keepalive requests sent to the server.  The connection is re-established if the server fails to answer one within that interval.  0 disables keepalive requests.")
+	rootCmd.Flags().DurationVar(&drainTimeout, "drainTimeout", 10*time.Second, "Time given to active connections to finish once a SIGINT or SIGTERM signal is received, before they are cut.")
+	rootCmd.Flags().BoolVar(&lazy, "lazy", false, "Open the local end of the tunnel right away but only sign the public key and connect to the server once a connection is accepted.")
+	rootCmd.Flags().DurationVar(&idleDisconnect, "idleDisconnect", 0, "Disconnect from the server once no connection has been forwarded for that long, reconnecting on demand.  0 keeps the connection open.")
+	rootCmd.Flags().BoolVar(&exitWhenIdle, "exitWhenIdle", false, "Exit instead of only disconnecting once idleDisconnect is reached.")
+	rootCmd.Flags().StringVar(&rateLimitFilename, "rateLimitFile", "", "File setting rateLimit, rateBurst, globalRateLimit and globalRateBurst, one name and value per line, overriding the flags.  It is read again when a SIGHUP signal is received, adjusting the rate limits of the running tunnel.")
+	addForwardFlags(rootCmd.Flags())
+}
 
-		keySigningService, err = vault.New("user")
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to create Vault client for key signing.  Error: %s\n", err)
-			return
-		}
+// addForwardFlags adds the flags limiting the forwarded connections to the
+// commands establishing a tunnel.
+func addForwardFlags(flags *pflag.FlagSet) {
+	flags.IntVar(&maxConnections, "maxConnections", 0, "Maximum number of connections forwarded concurrently.  Further connections wait for one to finish, unless rejectWhenFull is set.  0 means no limit.")
+	flags.BoolVar(&rejectWhenFull, "rejectWhenFull", false, "Close the connections accepted beyond maxConnections instead of queueing them.")
+	flags.DurationVar(&idleTimeout, "idleTimeout", 0, "Close forwarded connections through which no data went for that long.  0 disables the timeout.")
+	flags.DurationVar(&maxLifetime, "maxLifetime", 0, "Close forwarded connections once they have been open for that long.  0 disables the limit.")
+	flags.DurationVar(&dialTimeout, "dialTimeout", 30*time.Second, "Time given to connect to the remote end of the tunnel for each forwarded connection.  0 means no limit.")
+	flags.StringSliceVar(&allowedSourceStrs, "allowSource", nil, "Address or CIDR network allowed to connect to a TCP local end of the tunnel.  Repeat or separate with commas to allow several.  Any source is allowed when none is provided.")
+	flags.StringSliceVar(&allowedUserStrs, "allowUser", nil, "User, by name or ID, allowed to connect to a Unix domain socket local end of the tunnel, checked with the peer credentials.  Repeat or separate with commas to allow several.  Any user is allowed when none is provided.  Users other than the current one also need --socketMode, and --socketGroup if they are only members of it, to grant them access.")
+	flags.StringVar(&socketModeStr, "socketMode", "", "Permissions, in octal, of a Unix domain socket local end of the tunnel, such as 0660.")
+	flags.StringVar(&socketOwner, "socketOwner", "", "Owner, by name or ID, of a Unix domain socket local end of the tunnel.")
+	flags.StringVar(&socketGroup, "socketGroup", "", "Group, by name or ID, of a Unix domain socket local end of the tunnel.")
+	flags.BoolVar(&tlsEnabled, "tls", false, "Serve TLS on the local end of the tunnel.  Unless tlsCert and tlsKey are provided, a CA, a server certificate and a client certificate are generated, client certificates are required and the client material is written to tlsCertPath for use as DOCKER_CERT_PATH.")
+	flags.StringVar(&tlsCertFilename, "tlsCert", "", "File containing the TLS certificate served on the local end of the tunnel.")
+	flags.StringVar(&tlsKeyFilename, "tlsKey", "", "File containing the key of the TLS certificate served on the local end of the tunnel.")
+	flags.StringVar(&tlsClientCAFilename, "tlsClientCA", "", "File containing the CA certificates client certificates must be signed by.  Client certificates are only required when provided, or when the TLS material is generated.")
+	flags.StringVar(&tlsCertPath, "tlsCertPath", "", "Directory in which the generated CA and client certificate are written as ca.pem, cert.pem and key.pem.  A temporary directory, removed on exit, is used when not provided.")
+	flags.StringVar(&rateLimitStr, "rateLimit", "", "Maximum rate, in bytes per second, at which data goes through each forward, both directions together.  K, M and G suffixes multiply by 1024, 1024² and 1024³.  No limit when not provided.")
+	flags.StringVar(&rateBurstStr, "rateBurst", "", "Amount of data, in bytes, let through at once above rateLimit.  Defaults to one second worth of data.")
+	flags.StringVar(&globalRateLimitStr, "globalRateLimit", "", "Maximum rate, in bytes per second, at which data goes through all the forwards together.  No limit when not provided.")
+	flags.StringVar(&globalRateBurstStr, "globalRateBurst", "", "Amount of data, in bytes, let through at once above globalRateLimit.  Defaults to one second worth of data.")
+	flags.StringVar(&captureDir, "captureDir", "", "Directory in which the data of every forwarded connection is written, with its time and direction, to a file of its own.  Captures may hold credentials.")
+	flags.StringVar(&capturePcapngFilename, "capturePcapng", "", "File to which the forwarded connections are written in pcapng format, as TCP segments between synthetic addresses, for Wireshark and similar tools.  Connections to a Unix domain socket appear on port 80.")
+	flags.StringVar(&captureHTTPFilename, "captureHTTP", "", "File, or - for standard error, to which the HTTP requests and responses exchanged through the forwarded connections, such as Docker Engine API calls to /var/run/docker.sock, are printed.")
+	flags.BoolVar(&allowPublicBind, "allowPublicBind", false, "Allow exposing a sensitive remote, such as the Docker daemon's socket, on a non-loopback local address.  Anyone able to connect to it gets root-equivalent access to the server.")
+}
 
-		certificate, err := keySigningService.SignKey(publicKey, username)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to sign public key.  Error: %s\n", err)
-			return
-		}
+// parseAccess builds the access control of the local end of the tunnel from
+// the flags.
+func parseAccess() (tunnel.Access, error) {
+	access := tunnel.Access{
+		SocketOwner: socketOwner,
+		SocketGroup: socketGroup,
+		AllowPublic: allowPublicBind,
+	}
 
-		privateKey, err := os.Open(privateKeyFilename)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to open private key file %s.  Error: %s\n", privateKeyFilename, err)
-			return
+	for _, source := range allowedSourceStrs {
+		if !strings.Contains(source, "/") {
+			if ip := net.ParseIP(source); ip != nil && ip.To4() != nil {
+				source += "/32"
+			} else {
+				source += "/128"
+			}
 		}
 
-		certificateSigner, err := tunnel.CreateSigner(privateKey, certificate)
+		_, network, err := net.ParseCIDR(source)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to create public key signer.  Error: %s\n", err)
-			return
-		}
-
-		if !strings.Contains(serverAddress, ":") {
-			serverAddress = serverAddress + ":22"
+			return access, fmt.Errorf("failed to parse allowed source %s.  Error: %s", source, err)
 		}
+		access.AllowedSources = append(access.AllowedSources, network)
+	}
 
-		server, err := net.ResolveTCPAddr("tcp", serverAddress)
+	for _, name := range allowedUserStrs {
+		u, err := user.Lookup(name)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to parse server address %s.  Error: %s\n", serverAddress, err)
-			return
+			if u, err = user.LookupId(name); err != nil {
+				return access, fmt.Errorf("failed to find allowed user %s.  Error: %s", name, err)
+			}
 		}
 
-		local, err := parseAddress(localAddressStr)
+		uid, err := strconv.Atoi(u.Uid)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to parse local address %s.  Error: %s\n", localAddressStr, err)
-			return
+			return access, fmt.Errorf("user %s has non-numeric ID %s", name, u.Uid)
 		}
+		access.AllowedUIDs = append(access.AllowedUIDs, uid)
+	}
 
-		remote, err := parseAddress(remoteAddressStr)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to parse remote address %s.  Error: %s\n", remoteAddressStr, err)
-			return
+	if socketModeStr != "" {
+		mode, err := strconv.ParseUint(socketModeStr, 8, 32)
+		if err != nil || mode > 0777 {
+			return access, fmt.Errorf("invalid socket mode %s, expected octal permissions such as 0660", socketModeStr)
 		}
+		access.SocketMode = os.FileMode(mode)
+	}
 
-		tunnel.Create(username, certificateSigner, server, local, remote)
-	},
-}
-
-func init() {
-	rootCmd.Flags().StringVarP(&privateKeyFilename, "privateKey", "k", "", "File containing the private SSH key used to connect to the server.")
-	rootCmd.Flags().StringVarP(&publicKeyFilename, "publicKey", "p", "", "File containing the public SSH key to sign.")
-	rootCmd.Flags().StringVarP(&localAddressStr, "localAddress", "l", "", "Network address of local port of the tunnel to establish.")
-	rootCmd.Flags().StringVarP(&remoteAddressStr, "remoteAddress", "r", "", "Network address of remote port of the tunnel to establish.")
+	return access, nil
 }
 
 // Execute executes the rootCmd Command.
 func Execute() {
 	err := rootCmd.Execute()
+	shutdownTracing()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error encountered during execution: %s\n", err)
+		logger.Error("execution failed", "error", err)
 		os.Exit(1)
 	}
+
+	os.Exit(exitCode)
+}
+
+// runTunnel establishes the tunnel until a SIGINT or SIGTERM signal is
+// received, reloading the rate limits on SIGHUP, and returns the exit code of
+// the process: 0 when the tunnel shut down cleanly, 1 when it could not be
+// established and 2 when active connections had to be cut because they did
+// not finish within the drain timeout.
+func runTunnel(cmd *cobra.Command, args []string) int {
+	if len(args) < 1 {
+		logger.Error("missing argument")
+		fmt.Fprintln(os.Stderr, cmd.UsageString())
+		return 1
+	}
+
+	if len(args) > 1 {
+		logger.Warn("extra arguments will be ignored")
+	}
+
+	options, err := loadServer(args[0])
+	if err != nil {
+		logger.Error("failed to load keys", "error", err)
+		return 1
+	}
+	options.DrainTimeout = drainTimeout
+
+	local, listener, err := parseLocalAddress(localAddressStr)
+	if err != nil {
+		logger.Error("failed to parse local address", "address", localAddressStr, "error", err)
+		return 1
+	}
+
+	remote, err := parseAddress(remoteAddressStr)
+	if err != nil {
+		logger.Error("failed to parse remote address", "address", remoteAddressStr, "error", err)
+		return 1
+	}
+
+	if err := setupRateLimits(); err != nil {
+		logger.Error("failed to set up rate limits", "error", err)
+		return 1
+	}
+	defer logThrottled()
+
+	options.Capture, err = setupCapture()
+	if err != nil {
+		logger.Error("failed to set up capture", "error", err)
+		return 1
+	}
+	if options.Capture != nil {
+		defer options.Capture.Close()
+	}
+
+	if exitWhenIdle && idleDisconnect <= 0 {
+		logger.Warn("exitWhenIdle has no effect unless idleDisconnect is set")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		notifySystemd("STOPPING=1")
+	}()
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+	go func() {
+		for {
+			select {
+			case <-reload:
+				reloadRateLimits()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	tlsConfig, certPath, cleanup, err := setupTLS()
+	if err != nil {
+		logger.Error("failed to set up TLS", "error", err)
+		return 1
+	}
+	defer cleanup()
+
+	t, err := startTunnel(ctx, options, local, listener, remote, tlsConfig)
+	if err != nil {
+		logger.Error("failed to establish tunnel", "error", err)
+		return 1
+	}
+
+	if certPath != "" {
+		logger.Info("TLS client material written", "cert_path", certPath)
+	}
+	signalReady(t.Addr())
+	defer removeReadyFiles()
+
+	err = t.Wait()
+	if err == tunnel.ErrDrainTimeout {
+		logger.Error("tunnel shut down with an error", "error", err)
+		return 2
+	}
+	if err != nil {
+		logger.Error("tunnel shut down with an error", "error", err)
+		return 1
+	}
+
+	return 0
 }
 
 func parseArg(arg string) (username, server string, err error) {
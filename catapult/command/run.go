@@ -0,0 +1,245 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+var runParallel int
+
+var runSummaryFilename string
+
+var runCmd = &cobra.Command{
+	Use:   "run username@server... -- command [args...]",
+	Short: "Runs a command on one or more servers.",
+	Long: `Run connects to each of the specified servers and executes the given command on them.
+The output of the command is streamed with each line prefixed by the server it comes from.
+Once the command has completed on every server, catapult exits with 0 if it succeeded
+everywhere, or 1 otherwise.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		exitCode = runRun(cmd, args)
+	},
+}
+
+func init() {
+	runCmd.Flags().IntVarP(&runParallel, "parallel", "P", 10, "Maximum number of servers on which the command runs concurrently.")
+	runCmd.Flags().StringVar(&runSummaryFilename, "summary", "", "File in which a JSON summary of the exit status on each server is written.  Use - to write it to stdout.")
+
+	rootCmd.AddCommand(runCmd)
+}
+
+// runResult holds the outcome of running the command on a server.
+type runResult struct {
+	Server     string  `json:"server"`
+	ExitStatus int     `json:"exitStatus"`
+	Error      string  `json:"error,omitempty"`
+	Duration   float64 `json:"durationSeconds"`
+}
+
+// runSummary is written as JSON once the command completed on every server.
+type runSummary struct {
+	Command   string      `json:"command"`
+	Succeeded int         `json:"succeeded"`
+	Failed    int         `json:"failed"`
+	Results   []runResult `json:"results"`
+}
+
+func runRun(cmd *cobra.Command, args []string) int {
+	dash := cmd.ArgsLenAtDash()
+	if dash < 1 || dash == len(args) {
+		logger.Error("at least one server argument and a command separated by -- are required")
+		fmt.Fprintln(os.Stderr, cmd.UsageString())
+		return 1
+	}
+	servers, command := args[:dash], strings.Join(args[dash:], " ")
+
+	if runParallel < 1 {
+		logger.Error("parallel must be at least 1", "parallel", runParallel)
+		return 1
+	}
+
+	signers, err := loadSigners()
+	if err != nil {
+		logger.Error("failed to load keys", "error", err)
+		return 1
+	}
+
+	var outputMutex sync.Mutex
+	width := 0
+	for _, server := range servers {
+		if len(server) > width {
+			width = len(server)
+		}
+	}
+
+	results := make([]runResult, len(servers))
+	semaphore := make(chan struct{}, runParallel)
+
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server string) {
+			defer wg.Done()
+
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			prefix := fmt.Sprintf("%-*s | ", width, server)
+			stdout := newPrefixWriter(os.Stdout, prefix, &outputMutex)
+			stderr := newPrefixWriter(os.Stderr, prefix, &outputMutex)
+
+			results[i] = runOnServer(signers, server, command, stdout, stderr)
+
+			stdout.Flush()
+			stderr.Flush()
+		}(i, server)
+	}
+	wg.Wait()
+
+	summary := runSummary{
+		Command: command,
+		Results: results,
+	}
+	for _, result := range results {
+		if result.ExitStatus == 0 {
+			summary.Succeeded++
+		} else {
+			summary.Failed++
+		}
+	}
+
+	if runSummaryFilename != "" {
+		if err := writeSummary(runSummaryFilename, summary); err != nil {
+			logger.Error("failed to write summary", "file", runSummaryFilename, "error", err)
+			return 1
+		}
+	}
+
+	if summary.Failed > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// runOnServer connects to the server and runs the command in a new session.
+// Failures to connect or to obtain an exit status are reported with an exit
+// status of -1.
+func runOnServer(signers *certificateSigners, server, command string, stdout, stderr io.Writer) runResult {
+	start := time.Now()
+	result := runResult{Server: server, ExitStatus: -1}
+
+	client, err := signers.connect(server)
+	if err == nil {
+		defer client.Close()
+		result.ExitStatus, err = runSession(client, command, stdout, stderr)
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+		logger.Error("failed to run command", "server", server, "error", err)
+	}
+
+	result.Duration = time.Since(start).Seconds()
+	return result
+}
+
+// runSession runs the command in a new session of the provided client and
+// returns its exit status.
+func runSession(client *ssh.Client, command string, stdout, stderr io.Writer) (int, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return -1, fmt.Errorf("failed to open session: %s", err)
+	}
+	defer session.Close()
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	err = session.Run(command)
+	switch e := err.(type) {
+	case nil:
+		return 0, nil
+	case *ssh.ExitError:
+		return e.ExitStatus(), nil
+	case *ssh.ExitMissingError:
+		return -1, fmt.Errorf("command exited without an exit status")
+	}
+
+	return -1, fmt.Errorf("failed to run command: %s", err)
+}
+
+func writeSummary(filename string, summary runSummary) error {
+	content, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	content = append(content, '\n')
+
+	if filename == "-" {
+		_, err = os.Stdout.Write(content)
+		return err
+	}
+
+	return ioutil.WriteFile(filename, content, 0644)
+}
+
+// prefixWriter writes every complete line it receives to the underlying
+// writer, preceded by a prefix.  Writers sharing a mutex never interleave
+// their lines.
+type prefixWriter struct {
+	writer io.Writer
+	prefix string
+	mutex  *sync.Mutex
+	buffer bytes.Buffer
+}
+
+func newPrefixWriter(writer io.Writer, prefix string, mutex *sync.Mutex) *prefixWriter {
+	return &prefixWriter{
+		writer: writer,
+		prefix: prefix,
+		mutex:  mutex,
+	}
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buffer.Write(p)
+
+	for {
+		pos := bytes.IndexByte(w.buffer.Bytes(), '\n')
+		if pos == -1 {
+			return len(p), nil
+		}
+
+		if err := w.writeLine(w.buffer.Next(pos + 1)); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// Flush writes the incomplete line left in the buffer, if any.
+func (w *prefixWriter) Flush() error {
+	if w.buffer.Len() == 0 {
+		return nil
+	}
+
+	return w.writeLine(append(w.buffer.Next(w.buffer.Len()), '\n'))
+}
+
+func (w *prefixWriter) writeLine(line []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	_, err := fmt.Fprintf(w.writer, "%s%s", w.prefix, line)
+	return err
+}
@@ -0,0 +1,191 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+var shellCmd = &cobra.Command{
+	Use:   "shell username@server [-- command [args...]]",
+	Short: "Opens an interactive shell session on the specified server.",
+	Long: `Shell connects to the specified server and opens an interactive shell session on it,
+or runs the given command, with a pseudo-terminal sized to the local terminal.  The local
+terminal is put in raw mode for the duration of the session and restored when it ends.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		exitCode = runShell(cmd, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(shellCmd)
+}
+
+// runShell runs the interactive session and returns the exit status of the
+// remote shell or command, or 1 if the session could not be established.
+func runShell(cmd *cobra.Command, args []string) int {
+	var command string
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		command = strings.Join(args[dash:], " ")
+		args = args[:dash]
+	}
+
+	if len(args) != 1 {
+		logger.Error("a single server argument is required")
+		fmt.Fprintln(os.Stderr, cmd.UsageString())
+		return 1
+	}
+
+	signers, err := loadSigners()
+	if err != nil {
+		logger.Error("failed to load keys", "error", err)
+		return 1
+	}
+
+	client, err := signers.connect(args[0])
+	if err != nil {
+		logger.Error("failed to connect", "server", args[0], "error", err)
+		return 1
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		logger.Error("failed to open session", "error", err)
+		return 1
+	}
+	defer session.Close()
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	// The terminal is restored before any error is reported, so that the
+	// message is displayed properly, and when a signal terminates the
+	// session, so that the terminal is not left in raw mode.
+	var state *terminalState
+	var stateMutex sync.Mutex
+	fd := int(os.Stdin.Fd())
+	restore := func() {
+		stateMutex.Lock()
+		defer stateMutex.Unlock()
+
+		if state != nil {
+			restoreTerminal(fd, state)
+			state = nil
+		}
+	}
+	defer restore()
+
+	var terminated os.Signal
+	var terminatedMutex sync.Mutex
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		var sig os.Signal
+		select {
+		case sig = <-signals:
+		case <-done:
+			return
+		}
+
+		terminatedMutex.Lock()
+		terminated = sig
+		terminatedMutex.Unlock()
+
+		restore()
+		session.Close()
+		client.Close()
+	}()
+
+	if isTerminal(fd) {
+		width, height, err := terminalSize(fd)
+		if err != nil {
+			width, height = 80, 24
+		}
+
+		term := os.Getenv("TERM")
+		if term == "" {
+			term = "xterm"
+		}
+
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+
+		if err := session.RequestPty(term, height, width, modes); err != nil {
+			logger.Error("failed to request pseudo-terminal", "error", err)
+			return 1
+		}
+
+		stateMutex.Lock()
+		state, err = makeRaw(fd)
+		stateMutex.Unlock()
+		if err != nil {
+			logger.Error("failed to put terminal in raw mode", "error", err)
+			return 1
+		}
+
+		resized := make(chan os.Signal, 1)
+		notifyResize(resized)
+		defer signal.Stop(resized)
+
+		go func() {
+			for {
+				select {
+				case <-resized:
+				case <-done:
+					return
+				}
+
+				if width, height, err := terminalSize(fd); err == nil {
+					session.WindowChange(height, width)
+				}
+			}
+		}()
+	}
+
+	if command == "" {
+		err = session.Shell()
+	} else {
+		err = session.Start(command)
+	}
+	if err != nil {
+		restore()
+		logger.Error("failed to start session", "error", err)
+		return 1
+	}
+
+	err = session.Wait()
+
+	terminatedMutex.Lock()
+	sig := terminated
+	terminatedMutex.Unlock()
+	if sig != nil {
+		restore()
+		logger.Error("session closed on signal", "signal", sig.String())
+		return 128 + int(sig.(syscall.Signal))
+	}
+
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case *ssh.ExitError:
+		return e.ExitStatus()
+	default:
+		restore()
+		logger.Error("session ended abnormally", "error", e)
+		return 1
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package command
+
+import (
+	"errors"
+	"os"
+)
+
+var errTerminalUnsupported = errors.New("terminals are not supported on this platform")
+
+type terminalState struct{}
+
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (*terminalState, error) {
+	return nil, errTerminalUnsupported
+}
+
+func restoreTerminal(fd int, state *terminalState) error {
+	return errTerminalUnsupported
+}
+
+func terminalSize(fd int) (width, height int, err error) {
+	return 0, 0, errTerminalUnsupported
+}
+
+func notifyResize(c chan<- os.Signal) {
+}
@@ -0,0 +1,188 @@
+package command
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/marcboudreau/go-devops-talk/catapult/tunnel"
+)
+
+var rateLimitStr string
+
+var rateBurstStr string
+
+var globalRateLimitStr string
+
+var globalRateBurstStr string
+
+var rateLimitFilename string
+
+// forwardRateLimit and globalRateLimit are the rate limits of the forward and
+// of the whole tunnel, set up by setupRateLimits.  They are nil when there is
+// nothing to limit.
+var forwardRateLimit *tunnel.RateLimit
+
+var globalRateLimit *tunnel.RateLimit
+
+// rateLimits holds the rates and bursts, in bytes, of the rate limits.
+type rateLimits struct {
+	rate        int
+	burst       int
+	globalRate  int
+	globalBurst int
+}
+
+// setupRateLimits creates the rate limits requested by the flags and the rate
+// limit file.  When a rate limit file is provided, both rate limits are created
+// even if unlimited, so that reloadRateLimits can change them later on.
+func setupRateLimits() error {
+	limits, err := loadRateLimits()
+	if err != nil {
+		return err
+	}
+
+	if limits.rate > 0 || rateLimitFilename != "" {
+		forwardRateLimit = tunnel.NewRateLimit(limits.rate, limits.burst)
+	}
+	if limits.globalRate > 0 || rateLimitFilename != "" {
+		globalRateLimit = tunnel.NewRateLimit(limits.globalRate, limits.globalBurst)
+	}
+
+	return nil
+}
+
+// reloadRateLimits applies the rate limits from the rate limit file and the
+// flags, and logs them along with the time writes were held back so far.
+func reloadRateLimits() {
+	if rateLimitFilename == "" {
+		logger.Warn("no rate limit file to reload, use --rateLimitFile to provide one")
+		return
+	}
+
+	limits, err := loadRateLimits()
+	if err != nil {
+		logger.Error("failed to reload rate limits", "error", err)
+		return
+	}
+
+	forwardRateLimit.Set(limits.rate, limits.burst)
+	globalRateLimit.Set(limits.globalRate, limits.globalBurst)
+
+	logger.Info("rate limits reloaded", "rate", limits.rate, "burst", limits.burst, "global_rate", limits.globalRate, "global_burst", limits.globalBurst)
+	logThrottled()
+}
+
+// logThrottled logs the total time writes were held back by the rate limits,
+// if they were.
+func logThrottled() {
+	throttled, globalThrottled := forwardRateLimit.Throttled(), globalRateLimit.Throttled()
+	if throttled == 0 && globalThrottled == 0 {
+		return
+	}
+
+	logger.Info("throttled by rate limits", "throttled", throttled, "global_throttled", globalThrottled)
+}
+
+// loadRateLimits parses the rate limit flags, then the rate limit file, whose
+// values take precedence.
+func loadRateLimits() (rateLimits, error) {
+	values := map[string]string{
+		"rateLimit":       rateLimitStr,
+		"rateBurst":       rateBurstStr,
+		"globalRateLimit": globalRateLimitStr,
+		"globalRateBurst": globalRateBurstStr,
+	}
+
+	if rateLimitFilename != "" {
+		if err := readRateLimitFile(rateLimitFilename, values); err != nil {
+			return rateLimits{}, err
+		}
+	}
+
+	var limits rateLimits
+	for name, value := range map[string]*int{
+		"rateLimit":       &limits.rate,
+		"rateBurst":       &limits.burst,
+		"globalRateLimit": &limits.globalRate,
+		"globalRateBurst": &limits.globalBurst,
+	} {
+		size, err := parseByteSize(values[name])
+		if err != nil {
+			return rateLimits{}, fmt.Errorf("invalid %s %s.  Error: %s", name, values[name], err)
+		}
+		*value = size
+	}
+
+	return limits, nil
+}
+
+// readRateLimitFile reads the name value lines of the rate limit file into
+// values.  Empty lines and lines starting with # are ignored.
+func readRateLimitFile(filename string, values map[string]string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open rate limit file %s.  Error: %s", filename, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(text, func(r rune) bool {
+			return r == '=' || r == ' ' || r == '\t'
+		})
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid line %d of rate limit file %s, expected a name and a value", line, filename)
+		}
+
+		name := strings.TrimPrefix(fields[0], "--")
+		if _, ok := values[name]; !ok {
+			return fmt.Errorf("unknown rate limit %s on line %d of rate limit file %s", name, line, filename)
+		}
+		values[name] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read rate limit file %s.  Error: %s", filename, err)
+	}
+
+	return nil
+}
+
+// parseByteSize parses a number of bytes, optionally followed by a K, M or G
+// suffix multiplying it by 1024, 1024² or 1024³.  An empty value is zero.
+func parseByteSize(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	multiplier := 1
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if size < 0 {
+		return 0, errors.New("negative size")
+	}
+
+	return size * multiplier, nil
+}
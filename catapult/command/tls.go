@@ -0,0 +1,214 @@
+package command
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var tlsEnabled bool
+
+var tlsCertFilename string
+
+var tlsKeyFilename string
+
+var tlsClientCAFilename string
+
+var tlsCertPath string
+
+// tlsValidity is how long the generated certificates are valid for.
+const tlsValidity = 365 * 24 * time.Hour
+
+// setupTLS returns the TLS configuration of the local end of the tunnel as
+// requested by the flags, or nil when TLS is not enabled.
+//
+// Without a provided certificate, a CA, a server certificate and a client
+// certificate are generated, client certificates are required, and the CA
+// and client certificate are written, as ca.pem, cert.pem and key.pem, to the
+// directory returned for use as DOCKER_CERT_PATH.  The cleanup function
+// removes that directory when it was created in the temporary directory.
+func setupTLS() (config *tls.Config, certPath string, cleanup func(), err error) {
+	cleanup = func() {}
+
+	if !tlsEnabled {
+		return nil, "", cleanup, nil
+	}
+
+	config = &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if tlsCertFilename != "" || tlsKeyFilename != "" {
+		certificate, err := tls.LoadX509KeyPair(tlsCertFilename, tlsKeyFilename)
+		if err != nil {
+			return nil, "", cleanup, fmt.Errorf("failed to load TLS certificate %s and key %s.  Error: %s", tlsCertFilename, tlsKeyFilename, err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+
+		if tlsClientCAFilename != "" {
+			pool, err := loadCertPool(tlsClientCAFilename)
+			if err != nil {
+				return nil, "", cleanup, err
+			}
+			config.ClientCAs = pool
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		return config, tlsCertPath, cleanup, nil
+	}
+
+	if tlsClientCAFilename != "" {
+		return nil, "", cleanup, errors.New("a client CA can only be provided along with a TLS certificate and key")
+	}
+
+	certPath = tlsCertPath
+	if certPath == "" {
+		if certPath, err = ioutil.TempDir("", "catapult-tls"); err != nil {
+			return nil, "", cleanup, fmt.Errorf("failed to create TLS certificate directory.  Error: %s", err)
+		}
+		cleanup = func() { os.RemoveAll(certPath) }
+	} else if err := os.MkdirAll(certPath, 0700); err != nil {
+		return nil, "", cleanup, fmt.Errorf("failed to create TLS certificate directory %s.  Error: %s", certPath, err)
+	}
+
+	config, err = generateTLSMaterial(certPath)
+	if err != nil {
+		cleanup()
+		return nil, "", func() {}, err
+	}
+
+	return config, certPath, cleanup, nil
+}
+
+// generateTLSMaterial generates a CA along with a server and a client
+// certificate signed by it, writes the CA and client certificate to the
+// directory and returns the server configuration requiring the client
+// certificate.
+func generateTLSMaterial(dir string) (*tls.Config, error) {
+	now := time.Now()
+
+	caKey, caCertificate, caDER, err := generateCertificate(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "catapult CA"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(tlsValidity),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	serverKey, _, serverDER, err := generateCertificate(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		NotBefore:   now.Add(-time.Minute),
+		NotAfter:    now.Add(tlsValidity),
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCertificate, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientKey, _, clientDER, err := generateCertificate(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "catapult client"},
+		NotBefore:   now.Add(-time.Minute),
+		NotAfter:    now.Add(tlsValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCertificate, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientKeyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []struct {
+		name     string
+		pemType  string
+		der      []byte
+		fileMode os.FileMode
+	}{
+		{"ca.pem", "CERTIFICATE", caDER, 0644},
+		{"cert.pem", "CERTIFICATE", clientDER, 0644},
+		{"key.pem", "EC PRIVATE KEY", clientKeyDER, 0600},
+	}
+	for _, file := range files {
+		content := pem.EncodeToMemory(&pem.Block{Type: file.pemType, Bytes: file.der})
+		if err := ioutil.WriteFile(filepath.Join(dir, file.name), content, file.fileMode); err != nil {
+			return nil, fmt.Errorf("failed to write TLS material to %s.  Error: %s", dir, err)
+		}
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCertificate)
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{serverDER, caDER},
+			PrivateKey:  serverKey,
+		}},
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// generateCertificate generates a key and a certificate from the template,
+// signed by the parent, or self-signed when the parent is nil.
+func generateCertificate(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, *x509.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to generate TLS key.  Error: %s", err)
+	}
+
+	template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to generate TLS certificate.  Error: %s", err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return key, certificate, der, nil
+}
+
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file %s.  Error: %s", filename, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no certificate found in client CA file %s", filename)
+	}
+
+	return pool, nil
+}
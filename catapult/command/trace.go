@@ -0,0 +1,67 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/marcboudreau/go-devops-talk/catapult/trace"
+)
+
+var traceEndpoint string
+
+var traceFilename string
+
+// tracer records the spans of the commands.  It is nil, and records nothing,
+// unless the traceEndpoint or traceFile flag is provided.
+var tracer *trace.Tracer
+
+var traceFile *os.File
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&traceEndpoint, "traceEndpoint", "", "URL of the OTLP/HTTP traces endpoint of an OpenTelemetry collector, such as http://localhost:4318/v1/traces, to which trace spans are exported.")
+	rootCmd.PersistentFlags().StringVar(&traceFilename, "traceFile", "", "File to which trace spans are appended, as one OTLP JSON document per line.")
+}
+
+// setupTracing creates the tracer exporting spans as requested by the
+// traceEndpoint and traceFile flags.
+func setupTracing() error {
+	var exporter trace.Exporter
+
+	switch {
+	case traceEndpoint != "" && traceFilename != "":
+		return fmt.Errorf("only one of traceEndpoint and traceFile can be provided")
+	case traceEndpoint != "":
+		exporter = trace.NewOTLPExporter(traceEndpoint, "catapult")
+	case traceFilename != "":
+		file, err := os.OpenFile(traceFilename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open trace file %s.  Error: %s", traceFilename, err)
+		}
+		traceFile = file
+		exporter = trace.NewFileExporter(file, "catapult")
+	default:
+		return nil
+	}
+
+	tracer = trace.NewTracer(exporter, 5*time.Second, func(err error) {
+		logger.Warn("failed to export trace spans", "error", err)
+	})
+
+	return nil
+}
+
+// shutdownTracing exports the spans that are still pending.
+func shutdownTracing() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := tracer.Shutdown(ctx); err != nil {
+		logger.Warn("failed to export trace spans", "error", err)
+	}
+
+	if traceFile != nil {
+		traceFile.Close()
+	}
+}
@@ -0,0 +1,129 @@
+package control
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/marcboudreau/go-devops-talk/catapult/tunnel"
+)
+
+// Client talks to the control master listening on a control socket.  It
+// implements the same DialContext method as *tunnel.Tunnel, so that it can be
+// used as the Dialer of a tunnel.
+type Client struct {
+	Path string
+}
+
+// NewClient returns a client of the control master listening on the control
+// socket at the provided path.
+func NewClient(path string) *Client {
+	return &Client{Path: path}
+}
+
+// DialContext asks the control master to connect to the address, which is
+// resolved by the server, and returns the connection.
+func (c *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, reader, _, err := c.do(ctx, request{Op: opDial, Network: network, Address: address})
+	if err != nil {
+		return nil, err
+	}
+
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// Status returns the status of the control master.
+func (c *Client) Status(ctx context.Context) (Status, error) {
+	conn, _, res, err := c.do(ctx, request{Op: opStatus})
+	if err != nil {
+		return Status{}, err
+	}
+	conn.Close()
+
+	if res.Status == nil {
+		return Status{}, errors.New("control master did not report its status")
+	}
+
+	return *res.Status, nil
+}
+
+// Stop asks the control master to shut down.
+func (c *Client) Stop(ctx context.Context) error {
+	conn, _, _, err := c.do(ctx, request{Op: opStop})
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// do sends the request and reads the response, returning the connection
+// along with the reader holding the data that followed the response, unless
+// the master reported an error.
+func (c *Client) do(ctx context.Context, req request) (net.Conn, *bufio.Reader, response, error) {
+	var res response
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", c.Path)
+	if err != nil {
+		return nil, nil, res, err
+	}
+
+	if err := c.checkMaster(conn); err != nil {
+		conn.Close()
+		return nil, nil, res, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+
+	reader := bufio.NewReader(conn)
+	err = writeMessage(conn, req)
+	if err == nil {
+		err = readMessage(reader, &res)
+	}
+
+	if !stop() && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+
+	if err == nil && res.Error != "" {
+		err = errors.New(res.Error)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, res, err
+	}
+
+	return conn, reader, res, nil
+}
+
+// checkMaster checks that the control master runs as the current user, so
+// that a socket planted by another user is never trusted.  Where the kernel
+// does not report the peer credentials, the directory of the socket is checked
+// instead, as only its owner could then have created the socket.
+func (c *Client) checkMaster(conn net.Conn) error {
+	uid, err := tunnel.PeerUID(conn)
+	if errors.Is(err, tunnel.ErrPeerCredentials) {
+		return CheckDir(filepath.Dir(c.Path))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read control master credentials.  Error: %s", err)
+	}
+
+	if uid != os.Getuid() {
+		return fmt.Errorf("control master on %s runs as user %d, not the current user", c.Path, uid)
+	}
+
+	return nil
+}
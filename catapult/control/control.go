@@ -0,0 +1,417 @@
+// Package control implements a control socket through which a long running
+// catapult process, the control master, shares its authenticated SSH
+// connection with other catapult processes, sparing them the key signing
+// round-trip and the SSH handshake.
+//
+// The protocol is line oriented: a client sends a request as a single line of
+// JSON and the master replies with a single line of JSON.  After a successful
+// reply to a dial request, the control connection carries the data of the
+// connection opened by the master.
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/marcboudreau/go-devops-talk/catapult/tunnel"
+)
+
+// requestTimeout bounds the time given to a client to send its request.
+const requestTimeout = 10 * time.Second
+
+// maxAcceptDelay bounds the time waited before accepting control connections
+// again after a temporary failure, such as running out of file descriptors.
+const maxAcceptDelay = time.Second
+
+const (
+	opDial   = "dial"
+	opStatus = "status"
+	opStop   = "stop"
+)
+
+// Dialer opens the connections requested through the control socket.  It is
+// implemented by *tunnel.Tunnel.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Status describes a control master.
+type Status struct {
+	PID               int       `json:"pid"`
+	Destination       string    `json:"destination"`
+	State             string    `json:"state"`
+	Started           time.Time `json:"started"`
+	ActiveConnections int64     `json:"active_connections"`
+	TotalConnections  uint64    `json:"total_connections"`
+}
+
+type request struct {
+	Op      string `json:"op"`
+	Network string `json:"network,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+type response struct {
+	Error  string  `json:"error,omitempty"`
+	Status *Status `json:"status,omitempty"`
+}
+
+// Options configures a Server.
+type Options struct {
+	// Dialer opens the connections requested by clients.
+	Dialer Dialer
+
+	// Destination describes the server the Dialer connects to, as reported
+	// by Status.
+	Destination string
+
+	// State returns the state of the connection to the server, as reported
+	// by Status.  It is optional.
+	State func() string
+
+	// DialTimeout bounds the time taken to open a requested connection.  Zero
+	// means no bound.
+	DialTimeout time.Duration
+
+	// Logger receives the server's activity.  When nil, slog.Default() is
+	// used.
+	Logger *slog.Logger
+}
+
+// Server serves the control socket of a control master.
+type Server struct {
+	options Options
+	logger  *slog.Logger
+	started time.Time
+
+	active atomic.Int64
+	total  atomic.Uint64
+
+	stopOnce sync.Once
+	stopped  chan struct{}
+
+	mutex     sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// NewServer returns a server opening the requested connections with the
+// dialer.
+func NewServer(options Options) (*Server, error) {
+	if options.Dialer == nil {
+		return nil, errors.New("no dialer provided")
+	}
+
+	logger := options.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return &Server{
+		options: options,
+		logger:  logger,
+		started: time.Now(),
+		stopped: make(chan struct{}),
+		conns:   make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Listen opens the control socket at the provided path, creating its parent
+// directory, accessible by the current user only, if needed.  An existing
+// directory owned by another user, or accessible by anyone else, is refused.
+// A socket file left behind by a master that did not shut down cleanly is
+// replaced, while one a running master listens on results in an error.
+func Listen(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create control socket directory.  Error: %s", err)
+	}
+
+	if err := CheckDir(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("refusing to use control socket directory.  Error: %s", err)
+	}
+
+	if _, err := os.Lstat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("a control master already listens on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale control socket.  Error: %s", err)
+		}
+	}
+
+	// The socket is accessible by the current user only from the start, the
+	// execute permission being dropped afterwards.
+	listener, _, err := tunnel.ListenPrivate("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict access to control socket.  Error: %s", err)
+	}
+
+	return listener, nil
+}
+
+// Serve accepts control connections on the listener until it is closed.  It
+// returns nil once the server is closed.  Temporary failures to accept, such
+// as running out of file descriptors, are retried after a growing delay.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listeners = append(s.listeners, listener)
+	s.mutex.Unlock()
+
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return nil
+			}
+
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Temporary() {
+				return err
+			}
+
+			if delay = 2 * delay; delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			s.logger.Warn("failed to accept control connection", "retry_in", delay, "error", err)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		if !s.track(conn) {
+			conn.Close()
+			return nil
+		}
+
+		go s.handle(conn)
+	}
+}
+
+// Stopped returns a channel that is closed once a client requests the master
+// to stop.
+func (s *Server) Stopped() <-chan struct{} {
+	return s.stopped
+}
+
+// Close stops accepting control connections and closes the active ones,
+// along with the connections opened for them.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	return nil
+}
+
+// Status returns the status of the master.
+func (s *Server) Status() Status {
+	status := Status{
+		PID:               os.Getpid(),
+		Destination:       s.options.Destination,
+		Started:           s.started,
+		ActiveConnections: s.active.Load(),
+		TotalConnections:  s.total.Load(),
+	}
+	if s.options.State != nil {
+		status.State = s.options.State()
+	}
+
+	return status
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.conns, conn)
+}
+
+// handle serves a single request made on the control connection.
+func (s *Server) handle(conn net.Conn) {
+	defer s.untrack(conn)
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	var req request
+	if err := readMessage(reader, &req); err != nil {
+		s.logger.Warn("failed to read control request", "error", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch req.Op {
+	case opStatus:
+		status := s.Status()
+		writeMessage(conn, response{Status: &status})
+		conn.Close()
+
+	case opStop:
+		s.logger.Info("stop requested through control socket")
+		writeMessage(conn, response{})
+		conn.Close()
+		s.stopOnce.Do(func() { close(s.stopped) })
+
+	case opDial:
+		s.dial(&bufferedConn{Conn: conn, reader: reader}, req)
+
+	default:
+		writeMessage(conn, response{Error: fmt.Sprintf("unknown operation %q", req.Op)})
+		conn.Close()
+	}
+}
+
+// dial opens the requested connection and relays the data between it and the
+// control connection until both directions are done.
+func (s *Server) dial(conn net.Conn, req request) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if s.options.DialTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.options.DialTimeout)
+	}
+	remote, err := s.options.Dialer.DialContext(ctx, req.Network, req.Address)
+	cancel()
+	if err != nil {
+		s.logger.Warn("failed to open connection for control client", "network", req.Network, "address", req.Address, "error", err)
+		writeMessage(conn, response{Error: err.Error()})
+		conn.Close()
+		return
+	}
+
+	if err := writeMessage(conn, response{}); err != nil {
+		remote.Close()
+		conn.Close()
+		return
+	}
+
+	s.active.Add(1)
+	s.total.Add(1)
+	defer s.active.Add(-1)
+
+	abort := func() {
+		conn.Close()
+		remote.Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		relay(remote, conn, abort)
+		wg.Done()
+	}()
+	go func() {
+		relay(conn, remote, abort)
+		wg.Done()
+	}()
+	wg.Wait()
+
+	conn.Close()
+	remote.Close()
+}
+
+// relay copies the data read from the reader to the writer.  Once the reader
+// reaches EOF, only the write side of the writer is closed, so that the other
+// direction can finish, while a failure calls abort.
+func relay(writer, reader net.Conn, abort func()) {
+	if _, err := io.Copy(writer, reader); err != nil {
+		abort()
+		return
+	}
+
+	closeWrite(writer)
+}
+
+// closeWrite closes the write side of the connection, or the whole connection
+// when it cannot be half-closed.
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		if err := c.CloseWrite(); err == nil {
+			return nil
+		}
+	}
+
+	return conn.Close()
+}
+
+func readMessage(reader *bufio.Reader, message interface{}) error {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(line, message)
+}
+
+func writeMessage(writer io.Writer, message interface{}) error {
+	line, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(append(line, '\n'))
+	return err
+}
+
+// bufferedConn reads through the reader that buffered the data following the
+// request or response line.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// CloseWrite closes the write side of the control connection, which the
+// other end passes on to the connection it relays.
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
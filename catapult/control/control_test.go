@@ -0,0 +1,299 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return listener
+}
+
+func newTestServer(t *testing.T) (*Server, string, func()) {
+	dir, err := ioutil.TempDir("", "catapult")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "control", "master.sock")
+	listener, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(Options{
+		Dialer:      &net.Dialer{},
+		Destination: "test@server:22",
+		State:       func() string { return "connected" },
+		DialTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	return server, path, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestControlDial(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	server, path, cleanup := newTestServer(t)
+	defer cleanup()
+	client := NewClient(path)
+
+	testcases := []struct {
+		address string
+
+		expectedErr bool
+	}{
+		// Connection is opened by the master and relayed
+		{
+			address: target.Addr().String(),
+		},
+		// Failure to connect is reported to the client
+		{
+			address:     closed.Addr().String(),
+			expectedErr: true,
+		},
+	}
+
+	for _, testcase := range testcases {
+		conn, err := client.DialContext(context.Background(), "tcp", testcase.address)
+		if testcase.expectedErr {
+			assert.NotNil(t, err)
+			continue
+		}
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		fmt.Fprint(conn, "hello")
+		reply := make([]byte, 5)
+		_, err = io.ReadFull(conn, reply)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(reply))
+
+		status, err := client.Status(context.Background())
+		if assert.Nil(t, err) {
+			assert.Equal(t, int64(1), status.ActiveConnections)
+		}
+		conn.Close()
+	}
+
+	status, err := client.Status(context.Background())
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.Getpid(), status.PID)
+		assert.Equal(t, "test@server:22", status.Destination)
+		assert.Equal(t, "connected", status.State)
+		assert.Equal(t, uint64(1), status.TotalConnections)
+	}
+	assert.Equal(t, server.Status().TotalConnections, status.TotalConnections)
+}
+
+func TestControlStop(t *testing.T) {
+	server, path, cleanup := newTestServer(t)
+	defer cleanup()
+
+	// A second master cannot take over the control socket.
+	_, err := Listen(path)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, NewClient(path).Stop(context.Background()))
+	select {
+	case <-server.Stopped():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server was not stopped")
+	}
+
+	server.Close()
+	_, err = NewClient(path).Status(context.Background())
+	assert.NotNil(t, err)
+}
+
+func TestListenReplacesStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catapult")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "master.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := Listen(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+}
+
+func TestControlHalfClose(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				request, _ := ioutil.ReadAll(conn)
+				conn.Write(request)
+				conn.Close()
+			}()
+		}
+	}()
+
+	_, path, cleanup := newTestServer(t)
+	defer cleanup()
+
+	conn, err := NewClient(path).DialContext(context.Background(), "tcp", target.Addr().String())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "hello")
+	assert.Nil(t, conn.(interface{ CloseWrite() error }).CloseWrite())
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := ioutil.ReadAll(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(reply))
+}
+
+func TestListenRefusesSharedDirectory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("directory permissions do not apply on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "catapult")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A directory someone else may have created beforehand is writable or
+	// readable by others.
+	shared := filepath.Join(dir, "shared")
+	if err := os.Mkdir(shared, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(shared, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Listen(filepath.Join(shared, "master.sock"))
+	assert.NotNil(t, err)
+
+	_, err = os.Lstat(filepath.Join(shared, "master.sock"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// temporaryError is a temporary failure to accept, such as EMFILE.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// failingListener fails to accept the provided number of times before
+// accepting connections.
+type failingListener struct {
+	net.Listener
+	failures atomic.Int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, temporaryError{}
+	}
+
+	return l.Listener.Accept()
+}
+
+func TestServeRetriesTemporaryErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catapult")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "master.sock")
+	listener, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := &failingListener{Listener: listener}
+	failing.failures.Store(3)
+
+	server, err := NewServer(Options{Dialer: &net.Dialer{}, Destination: "test@server:22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(failing) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	status, err := NewClient(path).Status(ctx)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "test@server:22", status.Destination)
+	}
+
+	assert.Nil(t, server.Close())
+	assert.Nil(t, <-served)
+}
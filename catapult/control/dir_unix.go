@@ -0,0 +1,33 @@
+//go:build !windows
+
+package control
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// CheckDir checks that the directory of a control socket is owned by the
+// current user and accessible by them only, as anyone else able to write to it
+// could replace the socket, or the files next to it, with their own.
+func CheckDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is owned by user %d, not the current user", dir, stat.Uid)
+	}
+
+	if info.Mode().Perm() != 0700 {
+		return fmt.Errorf("%s has permissions %04o, not 0700", dir, info.Mode().Perm())
+	}
+
+	return nil
+}
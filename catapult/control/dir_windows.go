@@ -0,0 +1,21 @@
+package control
+
+import (
+	"fmt"
+	"os"
+)
+
+// CheckDir checks that the directory of a control socket is a directory.
+// Access to it is controlled by ACLs on Windows, which are left as inherited.
+func CheckDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	return nil
+}
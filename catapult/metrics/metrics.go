@@ -0,0 +1,298 @@
+// Package metrics implements counters, gauges and histograms exposed in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds metrics and writes them in the Prometheus text format.  It is
+// safe for concurrent use.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []*vector
+	hooks   []func()
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// OnCollect registers a function called every time the metrics are written,
+// which gives it the opportunity to update gauges derived from the clock.
+func (r *Registry) OnCollect(hook func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.hooks = append(r.hooks, hook)
+}
+
+// WriteTo writes every metric of the registry in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	hooks := append([]func(){}, r.hooks...)
+	metrics := append([]*vector{}, r.metrics...)
+	r.mutex.Unlock()
+
+	for _, hook := range hooks {
+		hook()
+	}
+
+	var buffer bytes.Buffer
+	for _, metric := range metrics {
+		metric.write(&buffer)
+	}
+
+	return buffer.WriteTo(w)
+}
+
+// ServeHTTP serves the metrics of the registry.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+func (r *Registry) register(name, help, kind string, buckets []float64, labels []string) *vector {
+	v := &vector{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+
+	r.mutex.Lock()
+	r.metrics = append(r.metrics, v)
+	r.mutex.Unlock()
+
+	return v
+}
+
+// Counter is a metric whose value only goes up, with one value per distinct
+// set of label values.
+type Counter struct {
+	*vector
+}
+
+// NewCounter registers a counter with the provided label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{r.register(name, help, "counter", nil, labels)}
+	if len(labels) == 0 {
+		c.update(nil, func(*series) {})
+	}
+
+	return c
+}
+
+// Add adds the provided value, which must not be negative, to the counter.
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic("metrics: counter " + c.name + " cannot decrease")
+	}
+
+	c.update(labelValues, func(s *series) { s.value += value })
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Gauge is a metric whose value can go up and down, with one value per
+// distinct set of label values.
+type Gauge struct {
+	*vector
+}
+
+// NewGauge registers a gauge with the provided label names.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{r.register(name, help, "gauge", nil, labels)}
+	if len(labels) == 0 {
+		g.update(nil, func(*series) {})
+	}
+
+	return g
+}
+
+// Set sets the gauge to the provided value.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.update(labelValues, func(s *series) { s.value = value })
+}
+
+// Add adds the provided value, which may be negative, to the gauge.
+func (g *Gauge) Add(value float64, labelValues ...string) {
+	g.update(labelValues, func(s *series) { s.value += value })
+}
+
+// Inc increments the gauge by one.
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec decrements the gauge by one.
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets suited to
+// histograms of network latencies.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram samples observations, such as latencies, into buckets, with one
+// set of buckets per distinct set of label values.
+type Histogram struct {
+	*vector
+}
+
+// NewHistogram registers a histogram whose buckets have the provided upper
+// bounds, in increasing order, and with the provided label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{r.register(name, help, "histogram", buckets, labels)}
+	if len(labels) == 0 {
+		h.update(nil, func(*series) {})
+	}
+
+	return h
+}
+
+// Observe adds an observation to the histogram.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.update(labelValues, func(s *series) {
+		for i, bound := range h.buckets {
+			if value <= bound {
+				s.counts[i]++
+			}
+		}
+		s.count++
+		s.value += value
+	})
+}
+
+// vector holds the series of a metric, keyed by their label values.
+type vector struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	count       uint64
+}
+
+// get returns the series with the provided label values, creating it if
+// needed.  The vector's mutex must be held.
+func (v *vector) get(labelValues []string) *series {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{
+			labelValues: append([]string{}, labelValues...),
+			counts:      make([]uint64, len(v.buckets)),
+		}
+		v.series[key] = s
+	}
+
+	return s
+}
+
+func (v *vector) update(labelValues []string, update func(*series)) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	update(v.get(labelValues))
+}
+
+func (v *vector) write(w io.Writer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.series[key]
+
+		if v.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labelValues, ""), formatValue(s.value))
+			continue
+		}
+
+		for i, bound := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, s.labelValues, formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(v.labels, s.labelValues, ""), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labels, s.labelValues, ""), s.count)
+	}
+}
+
+// formatLabels formats the label pairs of a sample, adding the le label of
+// histogram buckets when provided.
+func formatLabels(names, values []string, le string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(values[i])))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=\"%s\"", le))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	registry := NewRegistry()
+
+	requests := registry.NewCounter("requests_total", "Requests handled.", "code")
+	requests.Inc("200")
+	requests.Add(2, "500")
+	requests.Inc("200")
+
+	active := registry.NewGauge("active", "Active \\ connections.")
+	active.Inc()
+	active.Inc()
+	active.Dec()
+
+	latency := registry.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(2)
+
+	escaped := registry.NewGauge("escaped", "Escaped label values.", "value")
+	escaped.Set(1, "a\"b\\c\nd")
+
+	collected := 0
+	registry.OnCollect(func() {
+		collected++
+	})
+
+	var buffer bytes.Buffer
+	_, err := registry.WriteTo(&buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, collected)
+	assert.Equal(t, `# HELP requests_total Requests handled.
+# TYPE requests_total counter
+requests_total{code="200"} 2
+requests_total{code="500"} 2
+# HELP active Active \\ connections.
+# TYPE active gauge
+active 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.55
+latency_seconds_count 3
+# HELP escaped Escaped label values.
+# TYPE escaped gauge
+escaped{value="a\"b\\c\nd"} 1
+`, buffer.String())
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("requests_total", "Requests handled.")
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, err := ioutil.ReadAll(recorder.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, string(body), "requests_total 0\n")
+}
+
+func TestLabelCountMismatch(t *testing.T) {
+	testcases := []struct {
+		labelValues []string
+		fails       bool
+	}{
+		// Matching label values
+		{
+			labelValues: []string{"a", "b"},
+		},
+		// Missing label value
+		{
+			labelValues: []string{"a"},
+			fails:       true,
+		},
+		// Extra label value
+		{
+			labelValues: []string{"a", "b", "c"},
+			fails:       true,
+		},
+	}
+
+	counter := NewRegistry().NewCounter("counter", "Counter.", "first", "second")
+
+	for _, testcase := range testcases {
+		if testcase.fails {
+			assert.Panics(t, func() { counter.Inc(testcase.labelValues...) })
+		} else {
+			assert.NotPanics(t, func() { counter.Inc(testcase.labelValues...) })
+		}
+	}
+}
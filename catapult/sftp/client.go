@@ -0,0 +1,701 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Status codes of version 3 of the SFTP protocol.
+const (
+	statusOK               = 0
+	statusEOF              = 1
+	statusNoSuchFile       = 2
+	statusPermissionDenied = 3
+)
+
+// maxDataLength is the largest amount of data read or written in a single
+// request, which every server is required to support.
+const maxDataLength = 32 * 1024
+
+// maxInFlight is the number of requests a single ReadAt or WriteAt call keeps
+// in flight, so that the transfer is not limited to maxDataLength per round
+// trip.
+const maxInFlight = 64
+
+// StatusError is returned when the server fails a request.
+type StatusError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("sftp: %s (status %d)", e.Message, e.Code)
+}
+
+// Client is an SFTP client.  It is safe for concurrent use.  Responses are
+// matched to their requests by identifier, so that concurrent calls, as well as
+// the chunks of a large read or write, are pipelined.
+type Client struct {
+	reader io.Reader
+	writer io.WriteCloser
+
+	// writeMutex keeps the packets of concurrent requests from interleaving.
+	writeMutex sync.Mutex
+
+	mutex   sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan response
+	err     error
+}
+
+// response is a response received for a request, or the error that stopped
+// the client from receiving it.
+type response struct {
+	packetType byte
+	reader     *reader
+	err        error
+}
+
+// NewClient starts the sftp subsystem in a new session of the provided SSH
+// client and returns an SFTP client using it.
+func NewClient(client *ssh.Client) (*Client, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	reader, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return NewClientPipe(reader, &sessionCloser{WriteCloser: writer, session: session})
+}
+
+// NewClientPipe returns an SFTP client exchanging packets with a server over
+// the provided reader and writer.  Closing the client closes the writer.
+func NewClientPipe(in io.Reader, out io.WriteCloser) (*Client, error) {
+	c := &Client{
+		reader:  in,
+		writer:  out,
+		pending: make(map[uint32]chan response),
+	}
+
+	var init buffer
+	init.byte(fxpInit)
+	init.uint32(3)
+
+	if err := writePacket(out, init); err != nil {
+		out.Close()
+		return nil, err
+	}
+
+	packetType, payload, err := readPacket(in)
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+
+	r := &reader{data: payload}
+	if version := r.uint32(); packetType != fxpVersion || r.err != nil || version != 3 {
+		out.Close()
+		return nil, errors.New("sftp: server does not support version 3 of the protocol")
+	}
+
+	go c.receive()
+
+	return c, nil
+}
+
+// Close closes the client and the session it uses.
+func (c *Client) Close() error {
+	return c.writer.Close()
+}
+
+// receive reads the responses and hands them to the requests waiting for
+// them, until the connection fails.
+func (c *Client) receive() {
+	for {
+		packetType, payload, err := readPacket(c.reader)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		r := &reader{data: payload}
+		id := r.uint32()
+
+		c.mutex.Lock()
+		responses, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mutex.Unlock()
+
+		if r.err != nil || !ok {
+			c.fail(errors.New("sftp: unexpected response identifier"))
+			return
+		}
+
+		responses <- response{packetType: packetType, reader: r}
+	}
+}
+
+// fail fails the pending requests, and every later one, with the error.
+func (c *Client) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+	for id, responses := range c.pending {
+		responses <- response{err: c.err}
+		delete(c.pending, id)
+	}
+}
+
+// send sends a packet built by the provided function and returns the channel
+// on which its response is delivered.
+func (c *Client) send(packetType byte, build func(*buffer)) (<-chan response, error) {
+	c.mutex.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mutex.Unlock()
+		return nil, err
+	}
+	c.nextID++
+	id := c.nextID
+	responses := make(chan response, 1)
+	c.pending[id] = responses
+	c.mutex.Unlock()
+
+	var packet buffer
+	packet.byte(packetType)
+	packet.uint32(id)
+	build(&packet)
+
+	c.writeMutex.Lock()
+	err := writePacket(c.writer, packet)
+	c.writeMutex.Unlock()
+	if err != nil {
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+		return nil, err
+	}
+
+	return responses, nil
+}
+
+// request sends a packet built by the provided function and returns the
+// response.
+func (c *Client) request(packetType byte, build func(*buffer)) (byte, *reader, error) {
+	responses, err := c.send(packetType, build)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	res := <-responses
+	return res.packetType, res.reader, res.err
+}
+
+// statusError converts a status response to an error, which is nil for the OK
+// status and io.EOF for the EOF status.
+func statusError(r *reader) error {
+	code := r.uint32()
+	message := r.string()
+	if r.err != nil {
+		return r.err
+	}
+
+	switch code {
+	case statusOK:
+		return nil
+	case statusEOF:
+		return io.EOF
+	case statusNoSuchFile:
+		return os.ErrNotExist
+	case statusPermissionDenied:
+		return os.ErrPermission
+	}
+
+	return &StatusError{Code: code, Message: message}
+}
+
+func unexpected(packetType byte) error {
+	return fmt.Errorf("sftp: unexpected response of type %d", packetType)
+}
+
+// expectStatus sends a request whose response is a status.
+func (c *Client) expectStatus(packetType byte, build func(*buffer)) error {
+	responses, err := c.send(packetType, build)
+	if err != nil {
+		return err
+	}
+
+	return (<-responses).status()
+}
+
+// status returns the error of a response that is expected to be a status.
+func (res response) status() error {
+	if res.err != nil {
+		return res.err
+	}
+
+	if res.packetType != fxpStatus {
+		return unexpected(res.packetType)
+	}
+
+	return statusError(res.reader)
+}
+
+// expectHandle sends a request whose response is a handle.
+func (c *Client) expectHandle(packetType byte, build func(*buffer)) (string, error) {
+	responseType, r, err := c.request(packetType, build)
+	if err != nil {
+		return "", err
+	}
+
+	switch responseType {
+	case fxpHandle:
+		handle := r.string()
+		return handle, r.err
+	case fxpStatus:
+		if err := statusError(r); err != nil {
+			return "", err
+		}
+	}
+
+	return "", unexpected(responseType)
+}
+
+// expectAttrs sends a request whose response is file attributes.
+func (c *Client) expectAttrs(packetType byte, build func(*buffer)) (*attributes, error) {
+	responseType, r, err := c.request(packetType, build)
+	if err != nil {
+		return nil, err
+	}
+
+	switch responseType {
+	case fxpAttrs:
+		attrs := r.attrs()
+		return attrs, r.err
+	case fxpStatus:
+		if err := statusError(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, unexpected(responseType)
+}
+
+func pathError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// Stat returns the attributes of the named file, following symbolic links.
+func (c *Client) Stat(name string) (os.FileInfo, error) {
+	attrs, err := c.expectAttrs(fxpStat, func(b *buffer) { b.string(name) })
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+
+	return &fileInfo{name: path.Base(name), attrs: attrs}, nil
+}
+
+// Lstat returns the attributes of the named file, without following symbolic
+// links.
+func (c *Client) Lstat(name string) (os.FileInfo, error) {
+	attrs, err := c.expectAttrs(fxpLstat, func(b *buffer) { b.string(name) })
+	if err != nil {
+		return nil, pathError("lstat", name, err)
+	}
+
+	return &fileInfo{name: path.Base(name), attrs: attrs}, nil
+}
+
+// ReadDir returns the entries of the named directory, excluding . and ..
+func (c *Client) ReadDir(name string) ([]os.FileInfo, error) {
+	handle, err := c.expectHandle(fxpOpendir, func(b *buffer) { b.string(name) })
+	if err != nil {
+		return nil, pathError("opendir", name, err)
+	}
+	defer c.closeHandle(handle)
+
+	var entries []os.FileInfo
+	for {
+		responseType, r, err := c.request(fxpReaddir, func(b *buffer) { b.string(handle) })
+		if err != nil {
+			return nil, pathError("readdir", name, err)
+		}
+
+		switch responseType {
+		case fxpName:
+			for count := r.uint32(); count > 0 && r.err == nil; count-- {
+				filename := r.string()
+				r.string()
+				attrs := r.attrs()
+
+				if filename != "." && filename != ".." {
+					entries = append(entries, &fileInfo{name: filename, attrs: attrs})
+				}
+			}
+			if r.err != nil {
+				return nil, pathError("readdir", name, r.err)
+			}
+		case fxpStatus:
+			if err := statusError(r); err == io.EOF {
+				return entries, nil
+			} else if err != nil {
+				return nil, pathError("readdir", name, err)
+			}
+			return nil, pathError("readdir", name, unexpected(responseType))
+		default:
+			return nil, pathError("readdir", name, unexpected(responseType))
+		}
+	}
+}
+
+// Mkdir creates the named directory with the provided permissions.
+func (c *Client) Mkdir(name string, perm os.FileMode) error {
+	return pathError("mkdir", name, c.expectStatus(fxpMkdir, func(b *buffer) {
+		b.string(name)
+		b.attrs(&attributes{flags: attrPermissions, permissions: uint32(perm.Perm())})
+	}))
+}
+
+// Remove removes the named file.
+func (c *Client) Remove(name string) error {
+	return pathError("remove", name, c.expectStatus(fxpRemove, func(b *buffer) { b.string(name) }))
+}
+
+// Rename renames the oldname file to newname.
+func (c *Client) Rename(oldname, newname string) error {
+	return pathError("rename", oldname, c.expectStatus(fxpRename, func(b *buffer) {
+		b.string(oldname)
+		b.string(newname)
+	}))
+}
+
+// Chmod changes the permissions of the named file.
+func (c *Client) Chmod(name string, mode os.FileMode) error {
+	return pathError("chmod", name, c.expectStatus(fxpSetstat, func(b *buffer) {
+		b.string(name)
+		b.attrs(&attributes{flags: attrPermissions, permissions: uint32(mode.Perm())})
+	}))
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (c *Client) Chtimes(name string, atime, mtime time.Time) error {
+	return pathError("chtimes", name, c.expectStatus(fxpSetstat, func(b *buffer) {
+		b.string(name)
+		b.attrs(&attributes{flags: attrACModTime, atime: uint32(atime.Unix()), mtime: uint32(mtime.Unix())})
+	}))
+}
+
+// RealPath returns the canonical absolute form of the provided path, which is
+// useful to resolve relative paths against the remote user's home directory.
+func (c *Client) RealPath(name string) (string, error) {
+	responseType, r, err := c.request(fxpRealpath, func(b *buffer) { b.string(name) })
+	if err != nil {
+		return "", pathError("realpath", name, err)
+	}
+
+	switch responseType {
+	case fxpName:
+		if count := r.uint32(); r.err == nil && count == 1 {
+			resolved := r.string()
+			return resolved, pathError("realpath", name, r.err)
+		}
+	case fxpStatus:
+		if err := statusError(r); err != nil {
+			return "", pathError("realpath", name, err)
+		}
+	}
+
+	return "", pathError("realpath", name, unexpected(responseType))
+}
+
+// Open opens the named file for reading.
+func (c *Client) Open(name string) (*File, error) {
+	return c.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file with the provided os.O_* flags, creating it
+// with the provided permissions if os.O_CREATE is set.
+func (c *Client) OpenFile(name string, flag int, perm os.FileMode) (*File, error) {
+	var pflags uint32
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		pflags = fxfRead
+	case os.O_WRONLY:
+		pflags = fxfWrite
+	case os.O_RDWR:
+		pflags = fxfRead | fxfWrite
+	}
+	if flag&os.O_APPEND != 0 {
+		pflags |= fxfAppend
+	}
+	if flag&os.O_CREATE != 0 {
+		pflags |= fxfCreat
+	}
+	if flag&os.O_TRUNC != 0 {
+		pflags |= fxfTrunc
+	}
+	if flag&os.O_EXCL != 0 {
+		pflags |= fxfExcl
+	}
+
+	handle, err := c.expectHandle(fxpOpen, func(b *buffer) {
+		b.string(name)
+		b.uint32(pflags)
+		if flag&os.O_CREATE != 0 {
+			b.attrs(&attributes{flags: attrPermissions, permissions: uint32(perm.Perm())})
+		} else {
+			b.attrs(&attributes{})
+		}
+	})
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+
+	return &File{client: c, name: name, handle: handle}, nil
+}
+
+func (c *Client) closeHandle(handle string) error {
+	return c.expectStatus(fxpClose, func(b *buffer) { b.string(handle) })
+}
+
+// File is a file opened on the server.
+type File struct {
+	client *Client
+	name   string
+	handle string
+	offset int64
+}
+
+// Name returns the name of the file as passed to Open or OpenFile.
+func (f *File) Name() string {
+	return f.name
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	return pathError("close", f.name, f.client.closeHandle(f.handle))
+}
+
+// Stat returns the attributes of the file.
+func (f *File) Stat() (os.FileInfo, error) {
+	attrs, err := f.client.expectAttrs(fxpFstat, func(b *buffer) { b.string(f.handle) })
+	if err != nil {
+		return nil, pathError("stat", f.name, err)
+	}
+
+	return &fileInfo{name: path.Base(f.name), attrs: attrs}, nil
+}
+
+// chunk is a part of a read or write sent as a single request.
+type chunk struct {
+	start     int
+	end       int
+	responses <-chan response
+}
+
+// sendChunks sends the requests built by the provided function for the
+// chunks of p following start, up to maxInFlight of them.  It only fails when
+// not even the first request could be sent.
+func (f *File) sendChunks(p []byte, start int, packetType byte, build func(b *buffer, c chunk)) ([]chunk, error) {
+	var chunks []chunk
+	for start < len(p) && len(chunks) < maxInFlight {
+		c := chunk{start: start, end: start + maxDataLength}
+		if c.end > len(p) {
+			c.end = len(p)
+		}
+
+		var err error
+		c.responses, err = f.client.send(packetType, func(b *buffer) { build(b, c) })
+		if err != nil {
+			if len(chunks) == 0 {
+				return nil, err
+			}
+			break
+		}
+
+		chunks = append(chunks, c)
+		start = c.end
+	}
+
+	return chunks, nil
+}
+
+// ReadAt reads len(p) bytes from the file starting at the provided offset.
+// Several chunks are requested at once.
+func (f *File) ReadAt(p []byte, offset int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		chunks, err := f.sendChunks(p, read, fxpRead, func(b *buffer, c chunk) {
+			b.string(f.handle)
+			b.uint64(uint64(offset) + uint64(c.start))
+			b.uint32(uint32(c.end - c.start))
+		})
+		if err != nil {
+			return read, pathError("read", f.name, err)
+		}
+
+		// The data is used up to the first chunk that fails or falls short,
+		// the following ones being requested again, but every response is
+		// waited for.
+		done := false
+		for _, c := range chunks {
+			res := <-c.responses
+			if done {
+				continue
+			}
+
+			var n int
+			n, err = f.readResponse(res, p[c.start:c.end])
+			read += n
+			done = err != nil || n < c.end-c.start
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+
+	return read, nil
+}
+
+// readResponse copies the data of a read response to p.
+func (f *File) readResponse(res response, p []byte) (int, error) {
+	if res.err != nil {
+		return 0, pathError("read", f.name, res.err)
+	}
+
+	switch res.packetType {
+	case fxpData:
+		data := res.reader.bytes()
+		if res.reader.err != nil {
+			return 0, pathError("read", f.name, res.reader.err)
+		}
+		return copy(p, data), nil
+	case fxpStatus:
+		err := statusError(res.reader)
+		if err == nil {
+			err = unexpected(res.packetType)
+		}
+		if err != io.EOF {
+			err = pathError("read", f.name, err)
+		}
+		return 0, err
+	}
+
+	return 0, pathError("read", f.name, unexpected(res.packetType))
+}
+
+// Read reads up to len(p) bytes from the current offset of the file.
+func (f *File) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+// WriteAt writes len(p) bytes to the file starting at the provided offset.
+// Several chunks are sent at once.
+func (f *File) WriteAt(p []byte, offset int64) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunks, err := f.sendChunks(p, written, fxpWrite, func(b *buffer, c chunk) {
+			b.string(f.handle)
+			b.uint64(uint64(offset) + uint64(c.start))
+			b.bytes(p[c.start:c.end])
+		})
+		if err != nil {
+			return written, pathError("write", f.name, err)
+		}
+
+		// Only the chunks before the first failure count as written, but
+		// every response is waited for.
+		for _, c := range chunks {
+			if e := (<-c.responses).status(); e != nil && err == nil {
+				err = pathError("write", f.name, e)
+			}
+			if err == nil {
+				written = c.end
+			}
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// Write writes len(p) bytes at the current offset of the file.
+func (f *File) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+
+	return n, err
+}
+
+// Seek sets the offset of the next Read or Write on the file.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		info, err := f.Stat()
+		if err != nil {
+			return f.offset, err
+		}
+		offset += info.Size()
+	default:
+		return f.offset, pathError("seek", f.name, errors.New("invalid whence"))
+	}
+
+	if offset < 0 {
+		return f.offset, pathError("seek", f.name, errors.New("negative offset"))
+	}
+
+	f.offset = offset
+	return offset, nil
+}
+
+// sessionCloser closes the SSH session once the client is closed.
+type sessionCloser struct {
+	io.WriteCloser
+	session *ssh.Session
+}
+
+func (s *sessionCloser) Close() error {
+	s.WriteCloser.Close()
+	return s.session.Close()
+}
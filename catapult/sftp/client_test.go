@@ -0,0 +1,390 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient(t *testing.T) {
+	root, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	client := newTestClient(t, root)
+	defer client.Close()
+
+	// Directories
+	assert.Nil(t, client.Mkdir("dir", 0750))
+	info, err := client.Stat("dir")
+	if assert.Nil(t, err) {
+		assert.True(t, info.IsDir())
+		assert.Equal(t, "dir", info.Name())
+	}
+
+	// Writing a file larger than a single request
+	content := strings.Repeat("0123456789", 10000)
+	file, err := client.OpenFile("dir/file", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if assert.Nil(t, err) {
+		n, err := io.Copy(file, strings.NewReader(content))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(content)), n)
+		assert.Nil(t, file.Close())
+	}
+
+	written, err := ioutil.ReadFile(filepath.Join(root, "dir", "file"))
+	assert.Nil(t, err)
+	assert.Equal(t, content, string(written))
+
+	// Reading it back
+	file, err = client.Open("dir/file")
+	if assert.Nil(t, err) {
+		read, err := ioutil.ReadAll(file)
+		assert.Nil(t, err)
+		assert.Equal(t, content, string(read))
+
+		info, err := file.Stat()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(content)), info.Size())
+		assert.Equal(t, os.FileMode(0640), info.Mode())
+
+		offset, err := file.Seek(-10, io.SeekEnd)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(content)-10), offset)
+
+		tail, err := ioutil.ReadAll(file)
+		assert.Nil(t, err)
+		assert.Equal(t, "0123456789", string(tail))
+		assert.Nil(t, file.Close())
+	}
+
+	// Attributes
+	mtime := time.Unix(1500000000, 0)
+	assert.Nil(t, client.Chmod("dir/file", 0600))
+	assert.Nil(t, client.Chtimes("dir/file", mtime, mtime))
+	info, err = client.Lstat("dir/file")
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode())
+		assert.True(t, mtime.Equal(info.ModTime()))
+	}
+
+	// Listing
+	assert.Nil(t, client.Rename("dir/file", "dir/renamed"))
+	assert.Nil(t, client.Mkdir("dir/sub", 0755))
+	entries, err := client.ReadDir("dir")
+	if assert.Nil(t, err) {
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		sort.Strings(names)
+		assert.Equal(t, []string{"renamed", "sub"}, names)
+	}
+
+	// Errors
+	_, err = client.Stat("missing")
+	assert.True(t, os.IsNotExist(err))
+	_, err = client.Open("missing")
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, client.Remove("dir/renamed"))
+	_, err = client.Stat("dir/renamed")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestClientPipelining(t *testing.T) {
+	root, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// With 20ms per round trip, reading or writing 2 MiB one 32 KiB chunk at
+	// a time would take over a second each.
+	client := newLatencyTestClient(t, root, 20*time.Millisecond)
+	defer client.Close()
+
+	content := make([]byte, 2*1024*1024)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	started := time.Now()
+
+	file, err := client.OpenFile("large", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if !assert.Nil(t, err) {
+		return
+	}
+	n, err := file.WriteAt(content, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, len(content), n)
+	assert.Nil(t, file.Close())
+
+	file, err = client.Open("large")
+	if !assert.Nil(t, err) {
+		return
+	}
+	read := make([]byte, len(content)+10)
+	n, err = file.ReadAt(read, 0)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, len(content), n)
+	assert.True(t, bytes.Equal(content, read[:n]))
+	assert.Nil(t, file.Close())
+
+	assert.True(t, time.Since(started) < 500*time.Millisecond, "transfer took %s", time.Since(started))
+}
+
+func TestReaderShortPacket(t *testing.T) {
+	r := &reader{data: []byte{0, 0, 0, 5, 'a'}}
+	assert.Equal(t, "", r.string())
+	assert.Equal(t, errShortPacket, r.err)
+
+	r = &reader{data: []byte{0, 0}}
+	r.uint32()
+	assert.Equal(t, errShortPacket, r.err)
+}
+
+// newTestClient returns a client connected to an in-process server serving
+// the files below the provided root directory.
+func newTestClient(t *testing.T, root string) *Client {
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+
+	go serveTestClient(root, serverReader, serverWriter)
+
+	client, err := NewClientPipe(clientReader, clientWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+// newLatencyTestClient returns a client connected to an in-process server
+// whose responses are delivered after the provided latency.
+func newLatencyTestClient(t *testing.T, root string, latency time.Duration) *Client {
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+
+	go serveTestClient(root, serverReader, newDelayedWriter(serverWriter, latency))
+
+	client, err := NewClientPipe(clientReader, clientWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+// delayedWriter delivers every write to the underlying writer once the
+// latency has elapsed, without holding back the writes that follow.
+type delayedWriter struct {
+	writes chan delayedWrite
+}
+
+type delayedWrite struct {
+	at   time.Time
+	data []byte
+}
+
+func newDelayedWriter(writer io.WriteCloser, latency time.Duration) *delayedWriter {
+	w := &delayedWriter{writes: make(chan delayedWrite, 1024)}
+	go func() {
+		defer writer.Close()
+		for write := range w.writes {
+			time.Sleep(time.Until(write.at.Add(latency)))
+			writer.Write(write.data)
+		}
+	}()
+
+	return w
+}
+
+func (w *delayedWriter) Write(p []byte) (int, error) {
+	w.writes <- delayedWrite{at: time.Now(), data: append([]byte(nil), p...)}
+	return len(p), nil
+}
+
+func (w *delayedWriter) Close() error {
+	close(w.writes)
+	return nil
+}
+
+func serveTestClient(root string, in io.Reader, out io.WriteCloser) {
+	defer out.Close()
+
+	handles := make(map[string]*os.File)
+	nextHandle := 0
+
+	local := func(name string) string {
+		return filepath.Join(root, filepath.FromSlash(name))
+	}
+
+	for {
+		packetType, payload, err := readPacket(in)
+		if err != nil {
+			return
+		}
+
+		r := &reader{data: payload}
+		var response buffer
+
+		if packetType == fxpInit {
+			response.byte(fxpVersion)
+			response.uint32(3)
+			writePacket(out, response)
+			continue
+		}
+
+		id := r.uint32()
+		status := func(err error) {
+			response.byte(fxpStatus)
+			response.uint32(id)
+			switch {
+			case err == nil:
+				response.uint32(statusOK)
+			case err == io.EOF:
+				response.uint32(statusEOF)
+			case os.IsNotExist(err):
+				response.uint32(statusNoSuchFile)
+			case os.IsPermission(err):
+				response.uint32(statusPermissionDenied)
+			default:
+				response.uint32(4)
+			}
+			response.string("status")
+			response.string("")
+		}
+		attrs := func(info os.FileInfo) {
+			mode := uint32(info.Mode().Perm())
+			if info.IsDir() {
+				mode |= modeDirectory
+			} else {
+				mode |= modeRegular
+			}
+			response.attrs(&attributes{
+				flags:       attrSize | attrPermissions | attrACModTime,
+				size:        uint64(info.Size()),
+				permissions: mode,
+				atime:       uint32(info.ModTime().Unix()),
+				mtime:       uint32(info.ModTime().Unix()),
+			})
+		}
+		handle := func(file *os.File) {
+			nextHandle++
+			name := string(rune('a' + nextHandle))
+			handles[name] = file
+			response.byte(fxpHandle)
+			response.uint32(id)
+			response.string(name)
+		}
+
+		switch packetType {
+		case fxpOpen:
+			name, pflags, a := r.string(), r.uint32(), r.attrs()
+			flag := os.O_RDONLY
+			if pflags&fxfWrite != 0 {
+				flag = os.O_WRONLY
+				if pflags&fxfRead != 0 {
+					flag = os.O_RDWR
+				}
+			}
+			if pflags&fxfCreat != 0 {
+				flag |= os.O_CREATE
+			}
+			if pflags&fxfTrunc != 0 {
+				flag |= os.O_TRUNC
+			}
+			file, err := os.OpenFile(local(name), flag, os.FileMode(a.permissions&0777))
+			if err != nil {
+				status(err)
+				break
+			}
+			handle(file)
+		case fxpOpendir:
+			file, err := os.Open(local(r.string()))
+			if err != nil {
+				status(err)
+				break
+			}
+			handle(file)
+		case fxpClose:
+			name := r.string()
+			status(handles[name].Close())
+			delete(handles, name)
+		case fxpRead:
+			file, offset, length := handles[r.string()], r.uint64(), r.uint32()
+			data := make([]byte, length)
+			n, err := file.ReadAt(data, int64(offset))
+			if n == 0 {
+				status(err)
+				break
+			}
+			response.byte(fxpData)
+			response.uint32(id)
+			response.bytes(data[:n])
+		case fxpWrite:
+			file, offset, data := handles[r.string()], r.uint64(), r.bytes()
+			_, err := file.WriteAt(data, int64(offset))
+			status(err)
+		case fxpReaddir:
+			infos, err := handles[r.string()].Readdir(0)
+			if err != nil || len(infos) == 0 {
+				status(io.EOF)
+				break
+			}
+			response.byte(fxpName)
+			response.uint32(id)
+			response.uint32(uint32(len(infos)))
+			for _, info := range infos {
+				response.string(info.Name())
+				response.string(info.Name())
+				attrs(info)
+			}
+		case fxpStat, fxpLstat, fxpFstat:
+			var info os.FileInfo
+			if packetType == fxpFstat {
+				info, err = handles[r.string()].Stat()
+			} else {
+				info, err = os.Stat(local(r.string()))
+			}
+			if err != nil {
+				status(err)
+				break
+			}
+			response.byte(fxpAttrs)
+			response.uint32(id)
+			attrs(info)
+		case fxpSetstat:
+			name, a := local(r.string()), r.attrs()
+			var err error
+			if a.flags&attrPermissions != 0 {
+				err = os.Chmod(name, os.FileMode(a.permissions&0777))
+			}
+			if err == nil && a.flags&attrACModTime != 0 {
+				err = os.Chtimes(name, time.Unix(int64(a.atime), 0), time.Unix(int64(a.mtime), 0))
+			}
+			status(err)
+		case fxpMkdir:
+			name, a := r.string(), r.attrs()
+			status(os.Mkdir(local(name), os.FileMode(a.permissions&0777)))
+		case fxpRemove:
+			status(os.Remove(local(r.string())))
+		case fxpRename:
+			status(os.Rename(local(r.string()), local(r.string())))
+		default:
+			status(os.ErrInvalid)
+		}
+
+		writePacket(out, response)
+	}
+}
@@ -0,0 +1,263 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Packet types of version 3 of the SFTP protocol.
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpLstat    = 7
+	fxpFstat    = 8
+	fxpSetstat  = 9
+	fxpOpendir  = 11
+	fxpReaddir  = 12
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpRealpath = 16
+	fxpStat     = 17
+	fxpRename   = 18
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpName     = 104
+	fxpAttrs    = 105
+)
+
+// Flags of the open request.
+const (
+	fxfRead   = 0x01
+	fxfWrite  = 0x02
+	fxfAppend = 0x04
+	fxfCreat  = 0x08
+	fxfTrunc  = 0x10
+	fxfExcl   = 0x20
+)
+
+// Flags indicating which fields of the file attributes are present.
+const (
+	attrSize        = 0x01
+	attrUIDGID      = 0x02
+	attrPermissions = 0x04
+	attrACModTime   = 0x08
+	attrExtended    = 0x80000000
+)
+
+// File type bits of the permissions attribute.
+const (
+	modeTypeMask  = 0170000
+	modeDirectory = 0040000
+	modeSymlink   = 0120000
+	modeRegular   = 0100000
+)
+
+const maxPacketLength = 256 * 1024
+
+var errShortPacket = errors.New("sftp: packet too short")
+
+// buffer accumulates the fields of an outgoing packet.
+type buffer []byte
+
+func (b *buffer) byte(v byte) {
+	*b = append(*b, v)
+}
+
+func (b *buffer) uint32(v uint32) {
+	*b = append(*b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32((*b)[len(*b)-4:], v)
+}
+
+func (b *buffer) uint64(v uint64) {
+	*b = append(*b, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64((*b)[len(*b)-8:], v)
+}
+
+func (b *buffer) string(v string) {
+	b.uint32(uint32(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *buffer) bytes(v []byte) {
+	b.uint32(uint32(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *buffer) attrs(a *attributes) {
+	b.uint32(a.flags)
+	if a.flags&attrSize != 0 {
+		b.uint64(a.size)
+	}
+	if a.flags&attrUIDGID != 0 {
+		b.uint32(a.uid)
+		b.uint32(a.gid)
+	}
+	if a.flags&attrPermissions != 0 {
+		b.uint32(a.permissions)
+	}
+	if a.flags&attrACModTime != 0 {
+		b.uint32(a.atime)
+		b.uint32(a.mtime)
+	}
+}
+
+// reader consumes the fields of an incoming packet.
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil || len(r.data) < 1 {
+		r.err = errShortPacket
+		return 0
+	}
+
+	v := r.data[0]
+	r.data = r.data[1:]
+	return v
+}
+
+func (r *reader) uint32() uint32 {
+	if r.err != nil || len(r.data) < 4 {
+		r.err = errShortPacket
+		return 0
+	}
+
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *reader) uint64() uint64 {
+	if r.err != nil || len(r.data) < 8 {
+		r.err = errShortPacket
+		return 0
+	}
+
+	v := binary.BigEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v
+}
+
+func (r *reader) bytes() []byte {
+	length := r.uint32()
+	if r.err != nil || uint32(len(r.data)) < length {
+		r.err = errShortPacket
+		return nil
+	}
+
+	v := r.data[:length]
+	r.data = r.data[length:]
+	return v
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
+
+func (r *reader) attrs() *attributes {
+	a := &attributes{flags: r.uint32()}
+	if a.flags&attrSize != 0 {
+		a.size = r.uint64()
+	}
+	if a.flags&attrUIDGID != 0 {
+		a.uid = r.uint32()
+		a.gid = r.uint32()
+	}
+	if a.flags&attrPermissions != 0 {
+		a.permissions = r.uint32()
+	}
+	if a.flags&attrACModTime != 0 {
+		a.atime = r.uint32()
+		a.mtime = r.uint32()
+	}
+	if a.flags&attrExtended != 0 {
+		for count := r.uint32(); count > 0 && r.err == nil; count-- {
+			r.string()
+			r.string()
+		}
+	}
+
+	return a
+}
+
+// writePacket writes a packet, prefixed with its length, to the writer.
+func writePacket(w io.Writer, packet buffer) error {
+	var length buffer
+	length.uint32(uint32(len(packet)))
+
+	_, err := w.Write(append(length, packet...))
+	return err
+}
+
+// readPacket reads a packet from the reader and returns its type and payload.
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:])
+	if length < 1 || length > maxPacketLength {
+		return 0, nil, errors.New("sftp: invalid packet length")
+	}
+
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return 0, nil, err
+	}
+
+	return packet[0], packet[1:], nil
+}
+
+// attributes holds the file attributes exchanged in SFTP packets.
+type attributes struct {
+	flags       uint32
+	size        uint64
+	uid         uint32
+	gid         uint32
+	permissions uint32
+	atime       uint32
+	mtime       uint32
+}
+
+// fileMode converts the permissions attribute to an os.FileMode.
+func (a *attributes) fileMode() os.FileMode {
+	mode := os.FileMode(a.permissions & 0777)
+
+	switch a.permissions & modeTypeMask {
+	case modeDirectory:
+		mode |= os.ModeDir
+	case modeSymlink:
+		mode |= os.ModeSymlink
+	case modeRegular:
+	default:
+		if a.permissions&modeTypeMask != 0 {
+			mode |= os.ModeIrregular
+		}
+	}
+
+	return mode
+}
+
+// fileInfo implements os.FileInfo for the attributes of a remote file.
+type fileInfo struct {
+	name  string
+	attrs *attributes
+}
+
+func (f *fileInfo) Name() string       { return f.name }
+func (f *fileInfo) Size() int64        { return int64(f.attrs.size) }
+func (f *fileInfo) Mode() os.FileMode  { return f.attrs.fileMode() }
+func (f *fileInfo) ModTime() time.Time { return time.Unix(int64(f.attrs.mtime), 0) }
+func (f *fileInfo) IsDir() bool        { return f.Mode().IsDir() }
+func (f *fileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,217 @@
+// Package trace records spans timing the phases of establishing and using a
+// tunnel, and exports them in the OpenTelemetry protocol (OTLP) JSON encoding.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Exporter sends finished spans to their destination.
+type Exporter interface {
+	Export(ctx context.Context, spans []*Span) error
+}
+
+// Tracer records spans and hands them to an exporter in batches.  A nil
+// *Tracer records nothing, which allows instrumenting code unconditionally.
+type Tracer struct {
+	exporter Exporter
+	interval time.Duration
+	onError  func(error)
+
+	mutex   sync.Mutex
+	pending []*Span
+	flush   chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewTracer returns a tracer exporting spans with the provided exporter every
+// interval, and whenever enough spans are pending.  Export failures are passed
+// to onError, which may be nil.
+func NewTracer(exporter Exporter, interval time.Duration, onError func(error)) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		interval: interval,
+		onError:  onError,
+		flush:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	go t.run()
+
+	return t
+}
+
+// maxPending is the number of pending spans triggering an export before the
+// interval elapses.
+const maxPending = 512
+
+// Start starts a span, child of the span carried by the context if any, and
+// returns a context carrying the new span.
+func (t *Tracer) Start(ctx context.Context, name string, attributes ...Attribute) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer:     t,
+		Name:       name,
+		SpanID:     newID(8),
+		Start:      time.Now(),
+		Attributes: attributes,
+	}
+
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		span.TraceID = parent.TraceID
+		span.ParentSpanID = parent.SpanID
+	} else {
+		span.TraceID = newID(16)
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Shutdown exports the pending spans and stops the tracer.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	close(t.done)
+	<-t.stopped
+
+	return t.export(ctx)
+}
+
+func (t *Tracer) end(span *Span) {
+	t.mutex.Lock()
+	t.pending = append(t.pending, span)
+	full := len(t.pending) >= maxPending
+	t.mutex.Unlock()
+
+	if full {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.stopped)
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		case <-t.flush:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), t.interval)
+		if err := t.export(ctx); err != nil && t.onError != nil {
+			t.onError(err)
+		}
+		cancel()
+	}
+}
+
+func (t *Tracer) export(ctx context.Context) error {
+	t.mutex.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mutex.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	return t.exporter.Export(ctx, spans)
+}
+
+type spanKey struct{}
+
+// Span times an operation.  The methods of a nil *Span do nothing.
+type Span struct {
+	tracer *Tracer
+
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Start        time.Time
+	End          time.Time
+
+	mutex      sync.Mutex
+	Attributes []Attribute
+	Err        error
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Attributes = append(s.Attributes, attributes...)
+}
+
+// RecordError marks the span as failed with the provided error, if not nil.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Err = err
+}
+
+// Finish ends the span and queues it for export.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	s.End = time.Now()
+	s.mutex.Unlock()
+
+	s.tracer.end(s)
+}
+
+// Attribute is a key-value pair describing a span.  Values are strings,
+// integers, floats or booleans.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute.
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int64 returns an integer attribute.
+func Int64(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func newID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,108 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracerFileExporter(t *testing.T) {
+	var buffer bytes.Buffer
+	tracer := NewTracer(NewFileExporter(&buffer, "test"), time.Hour, nil)
+
+	ctx, parent := tracer.Start(context.Background(), "parent", String("server", "example.com:22"))
+	_, child := tracer.Start(ctx, "child")
+	child.SetAttributes(Int64("bytes", 42))
+	child.RecordError(errors.New("failed"))
+	child.Finish()
+	parent.Finish()
+
+	assert.Nil(t, tracer.Shutdown(context.Background()))
+
+	var request otlpRequest
+	if !assert.Nil(t, json.Unmarshal(buffer.Bytes(), &request)) {
+		return
+	}
+
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+
+	assert.Equal(t, "child", spans[0].Name)
+	assert.Equal(t, "parent", spans[1].Name)
+	assert.Equal(t, spans[1].TraceID, spans[0].TraceID)
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+	assert.Equal(t, "", spans[1].ParentSpanID)
+	assert.Len(t, spans[0].TraceID, 32)
+	assert.Len(t, spans[0].SpanID, 16)
+	assert.Equal(t, otlpStatus{Code: statusError, Message: "failed"}, spans[0].Status)
+	assert.Equal(t, otlpStatus{Code: statusOK}, spans[1].Status)
+	assert.Equal(t, "42", *spans[0].Attributes[0].Value.IntValue)
+	assert.Equal(t, "example.com:22", *spans[1].Attributes[0].Value.StringValue)
+	assert.Equal(t, "test", *request.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	testcases := []struct {
+		status int
+		fails  bool
+	}{
+		// Collector accepts the spans
+		{
+			status: http.StatusOK,
+		},
+		// Collector rejects the spans
+		{
+			status: http.StatusBadRequest,
+			fails:  true,
+		},
+	}
+
+	for _, testcase := range testcases {
+		var body []byte
+		var contentType string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = ioutil.ReadAll(r.Body)
+			contentType = r.Header.Get("Content-Type")
+			w.WriteHeader(testcase.status)
+		}))
+
+		tracer := NewTracer(NewOTLPExporter(server.URL+"/v1/traces", "test"), time.Hour, nil)
+		_, span := tracer.Start(context.Background(), "span")
+		span.Finish()
+
+		err := tracer.Shutdown(context.Background())
+		server.Close()
+
+		if testcase.fails {
+			assert.NotNil(t, err)
+			continue
+		}
+
+		assert.Nil(t, err)
+		assert.Equal(t, "application/json", contentType)
+		assert.Contains(t, string(body), `"name":"span"`)
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+
+	ctx, span := tracer.Start(context.Background(), "span")
+	assert.Equal(t, context.Background(), ctx)
+	assert.Nil(t, span)
+
+	span.SetAttributes(String("key", "value"))
+	span.RecordError(errors.New("failed"))
+	span.Finish()
+	assert.Nil(t, tracer.Shutdown(context.Background()))
+}
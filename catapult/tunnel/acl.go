@@ -0,0 +1,229 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// ErrExposed is returned, wrapped in a *ListenError, when a forward would
+// expose a sensitive remote on a non-loopback address without AllowPublic.
+var ErrExposed = errors.New("refusing to expose a sensitive remote address on a non-loopback address")
+
+// Access controls who may use the local end of a forward.
+type Access struct {
+	// AllowedSources restricts TCP listeners to connections coming from these
+	// networks.  When empty, connections from any source are accepted.
+	AllowedSources []*net.IPNet
+
+	// AllowedUIDs restricts Unix domain socket listeners to connections from
+	// processes running as one of these users, as reported by the kernel.
+	// When empty, any user able to open the socket is accepted.  Users other
+	// than the current one also need SocketMode, and SocketGroup if they are
+	// only members of it, to grant them access to the socket.
+	AllowedUIDs []int
+
+	// SocketMode sets the permissions of Unix domain socket listeners.  When
+	// zero, the permissions resulting from the umask are applied.  Either way,
+	// they are only applied once the owner and group are, the socket being
+	// accessible by the current user only until then.
+	SocketMode os.FileMode
+
+	// SocketOwner and SocketGroup set the owner and group of Unix domain
+	// socket listeners, by name or numeric ID.  When empty, the process's are
+	// kept.  The parent directories the tunnel creates for a socket get the
+	// group as well, and are private to the current user apart from the
+	// search permission granted to the group and others when SocketMode gives
+	// them access to the socket.
+	SocketOwner string
+	SocketGroup string
+
+	// AllowPublic allows listening on addresses other than loopback ones for
+	// sensitive remotes, such as the Docker daemon's socket, which grant
+	// root-equivalent access to the server to anyone able to connect.
+	AllowPublic bool
+}
+
+// checkAccess reports the configuration errors of the forward's access control.
+func (f Forward) checkAccess() error {
+	if len(f.Access.AllowedUIDs) > 0 && f.Local.Network() != "unix" {
+		return fmt.Errorf("allowed users can only be enforced on Unix domain socket listeners, not %s:%s", f.Local.Network(), f.Local.String())
+	}
+
+	if len(f.Access.AllowedSources) > 0 && !isTCP(f.Local) {
+		return fmt.Errorf("allowed sources can only be enforced on TCP listeners, not %s:%s", f.Local.Network(), f.Local.String())
+	}
+
+	if !f.Access.AllowPublic && isExposed(f.Local) && isSensitive(f.Remote) {
+		return &ListenError{Network: f.Local.Network(), Address: f.Local.String(), Err: ErrExposed}
+	}
+
+	return nil
+}
+
+// secureListener applies the socket ownership and then the permissions to a
+// Unix domain socket listener created by ListenPrivate, defaultMode being the
+// permissions it returned.
+func (f Forward) secureListener(listener net.Listener, defaultMode os.FileMode) error {
+	addr := listener.Addr()
+	if addr.Network() != "unix" {
+		return nil
+	}
+
+	uid, gid, err := f.Access.socketOwnership()
+	if err != nil {
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(addr.String(), uid, gid); err != nil {
+			return err
+		}
+	}
+
+	mode := f.Access.SocketMode
+	if mode == 0 {
+		mode = defaultMode
+	}
+	if mode == 0 {
+		return nil
+	}
+
+	return os.Chmod(addr.String(), mode)
+}
+
+// socketOwnership returns the IDs of the owner and group to set on Unix
+// domain socket listeners, which are -1 when they are not requested.
+func (a Access) socketOwnership() (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if a.SocketOwner != "" {
+		u, err := user.Lookup(a.SocketOwner)
+		if err != nil {
+			if u, err = user.LookupId(a.SocketOwner); err != nil {
+				return 0, 0, err
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+
+	if a.SocketGroup != "" {
+		g, err := user.LookupGroup(a.SocketGroup)
+		if err != nil {
+			if g, err = user.LookupGroupId(a.SocketGroup); err != nil {
+				return 0, 0, err
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	return uid, gid, nil
+}
+
+// socketDirMode returns the permissions of the parent directories created for
+// a Unix domain socket listener.  Connecting to a socket requires searching
+// every one of its parents, which is granted to the group and others when the
+// socket mode gives them any access.
+func (a Access) socketDirMode() os.FileMode {
+	mode := os.FileMode(0700)
+	if a.SocketMode&0070 != 0 {
+		mode |= 0010
+	}
+	if a.SocketMode&0007 != 0 {
+		mode |= 0001
+	}
+
+	return mode
+}
+
+// authorize checks that the connection accepted on the forward's listener is
+// allowed to use it.
+func (f Forward) authorize(conn net.Conn) error {
+	if len(f.Access.AllowedSources) > 0 {
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || !containsIP(f.Access.AllowedSources, addr.IP) {
+			return fmt.Errorf("source %s is not allowed", conn.RemoteAddr())
+		}
+	}
+
+	if len(f.Access.AllowedUIDs) > 0 {
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			conn = tlsConn.NetConn()
+		}
+
+		uid, err := PeerUID(conn)
+		if err != nil {
+			return fmt.Errorf("failed to read peer credentials: %s", err)
+		}
+
+		if !containsInt(f.Access.AllowedUIDs, uid) {
+			return fmt.Errorf("user %d is not allowed", uid)
+		}
+	}
+
+	return nil
+}
+
+func isTCP(addr net.Addr) bool {
+	switch addr.Network() {
+	case "tcp", "tcp4", "tcp6":
+		return true
+	}
+
+	return false
+}
+
+// isExposed reports whether the local address can be reached from other
+// hosts.
+func isExposed(addr net.Addr) bool {
+	if !isTCP(addr) {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsLoopback()
+}
+
+// isSensitive reports whether the remote address gives control over the
+// server: Unix domain sockets, such as the Docker daemon's, and the ports of
+// the Docker daemon's TCP API.
+func isSensitive(addr net.Addr) bool {
+	if addr.Network() == "unix" {
+		return true
+	}
+
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	n, _ := strconv.Atoi(port)
+	return n == 2375 || n == 2376
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
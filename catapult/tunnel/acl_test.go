@@ -0,0 +1,223 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckAccess(t *testing.T) {
+	loopback := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2375}
+	public := &net.TCPAddr{IP: net.IPv4zero, Port: 2375}
+	socket := &net.UnixAddr{Name: "/tmp/docker.sock", Net: "unix"}
+	dockerSocket := &net.UnixAddr{Name: "/var/run/docker.sock", Net: "unix"}
+	dockerPort := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2376}
+	webPort := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+
+	testcases := []struct {
+		forward Forward
+
+		exposed bool
+		fails   bool
+	}{
+		// Sensitive remote on a loopback address
+		{
+			forward: Forward{Local: loopback, Remote: dockerSocket},
+		},
+		// Sensitive remote on a Unix domain socket
+		{
+			forward: Forward{Local: socket, Remote: dockerSocket},
+		},
+		// Sensitive remote on a public address
+		{
+			forward: Forward{Local: public, Remote: dockerSocket},
+			exposed: true,
+			fails:   true,
+		},
+		// Docker API port on a public address
+		{
+			forward: Forward{Local: public, Remote: dockerPort},
+			exposed: true,
+			fails:   true,
+		},
+		// Sensitive remote on a public address, explicitly allowed
+		{
+			forward: Forward{Local: public, Remote: dockerSocket, Access: Access{AllowPublic: true}},
+		},
+		// Other remote on a public address
+		{
+			forward: Forward{Local: public, Remote: webPort},
+		},
+		// Allowed users on a TCP listener
+		{
+			forward: Forward{Local: loopback, Remote: dockerSocket, Access: Access{AllowedUIDs: []int{0}}},
+			fails:   true,
+		},
+		// Allowed sources on a Unix domain socket listener
+		{
+			forward: Forward{Local: socket, Remote: dockerSocket, Access: Access{AllowedSources: []*net.IPNet{network}}},
+			fails:   true,
+		},
+	}
+
+	for _, testcase := range testcases {
+		err := testcase.forward.checkAccess()
+		if testcase.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, testcase.exposed, errors.Is(err, ErrExposed))
+	}
+}
+
+func TestTunnelAccess(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	target := newEchoServer(t)
+	defer target.Close()
+
+	dir, err := ioutil.TempDir("", "catapult")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hops := StaticHops(Hop{Username: "test", Signer: signer, Address: server.Addr().String()})
+	socket := &net.UnixAddr{Name: filepath.Join(dir, "tunnel.sock"), Net: "unix"}
+	loopback := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	_, loopbackNetwork, _ := net.ParseCIDR("127.0.0.0/8")
+	_, privateNetwork, _ := net.ParseCIDR("10.0.0.0/8")
+
+	testcases := []struct {
+		local  net.Addr
+		access Access
+
+		refused bool
+		linux   bool
+	}{
+		// Source in an allowed network
+		{
+			local:  loopback,
+			access: Access{AllowedSources: []*net.IPNet{loopbackNetwork}},
+		},
+		// Source outside of the allowed networks
+		{
+			local:   loopback,
+			access:  Access{AllowedSources: []*net.IPNet{privateNetwork}},
+			refused: true,
+		},
+		// Socket restricted to its permissions
+		{
+			local:  socket,
+			access: Access{SocketMode: 0600},
+		},
+		// Peer running as an allowed user
+		{
+			local:  socket,
+			access: Access{AllowedUIDs: []int{os.Getuid()}},
+			linux:  true,
+		},
+		// Peer running as another user
+		{
+			local:   socket,
+			access:  Access{AllowedUIDs: []int{os.Getuid() + 1}},
+			refused: true,
+		},
+	}
+
+	for _, testcase := range testcases {
+		if testcase.linux && runtime.GOOS != "linux" {
+			continue
+		}
+
+		tunnel, err := New(Options{
+			Hops:     hops,
+			Forwards: []Forward{{Local: testcase.local, Remote: target.Addr(), Access: testcase.access}},
+		})
+		if !assert.Nil(t, err) || !assert.Nil(t, tunnel.Start(context.Background())) {
+			continue
+		}
+
+		if testcase.access.SocketMode != 0 {
+			info, err := os.Stat(socket.Name)
+			if assert.Nil(t, err) {
+				assert.Equal(t, testcase.access.SocketMode, info.Mode().Perm())
+			}
+		}
+
+		conn, err := net.Dial(tunnel.Addr().Network(), tunnel.Addr().String())
+		if assert.Nil(t, err) {
+			if testcase.refused {
+				_, err := conn.Read(make([]byte, 1))
+				assert.Equal(t, io.EOF, err)
+			} else {
+				assert.Nil(t, echo(conn, "hello"))
+			}
+			conn.Close()
+		}
+
+		tunnel.Close()
+	}
+}
+
+func TestTunnelTLS(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	target := newEchoServer(t)
+	defer target.Close()
+
+	// The test HTTPS server provides a certificate for 127.0.0.1 along with a
+	// client configuration trusting it.
+	https := httptest.NewTLSServer(http.NotFoundHandler())
+	defer https.Close()
+	clientConfig := https.Client().Transport.(*http.Transport).TLSClientConfig
+
+	tunnel, err := New(Options{
+		Hops: StaticHops(Hop{Username: "test", Signer: signer, Address: server.Addr().String()}),
+		Forwards: []Forward{{
+			Local:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+			Remote: target.Addr(),
+			TLS:    &tls.Config{Certificates: https.TLS.Certificates},
+		}},
+	})
+	if !assert.Nil(t, err) || !assert.Nil(t, tunnel.Start(context.Background())) {
+		return
+	}
+	defer tunnel.Close()
+
+	conn, err := tls.Dial("tcp", tunnel.Addr().String(), clientConfig)
+	if assert.Nil(t, err) {
+		assert.Nil(t, echo(conn, "hello"))
+		conn.Close()
+	}
+
+	plain, err := net.Dial("tcp", tunnel.Addr().String())
+	if assert.Nil(t, err) {
+		plain.SetReadDeadline(time.Now().Add(2 * time.Second))
+		assert.NotNil(t, echo(plain, "hello"))
+		plain.Close()
+	}
+}
@@ -0,0 +1,28 @@
+package tunnel
+
+import (
+	"log/slog"
+
+	"github.com/marcboudreau/go-devops-talk/catapult/capture"
+)
+
+// openCapture starts capturing the connection, or returns a stream discarding
+// its data when capture is not enabled or cannot be started.
+func (t *Tunnel) openCapture(conn capture.Conn, logger *slog.Logger) capture.Stream {
+	if t.options.Capture == nil {
+		return noCapture{}
+	}
+
+	stream, err := t.options.Capture.Open(conn)
+	if err != nil {
+		logger.Warn("failed to capture connection", "error", err)
+		return noCapture{}
+	}
+
+	return stream
+}
+
+type noCapture struct{}
+
+func (noCapture) Write(capture.Direction, []byte) {}
+func (noCapture) Close() error                    { return nil }
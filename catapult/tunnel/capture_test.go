@@ -0,0 +1,92 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marcboudreau/go-devops-talk/catapult/capture"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingCapture struct {
+	mutex    sync.Mutex
+	conns    []capture.Conn
+	sent     strings.Builder
+	received strings.Builder
+	closed   int
+}
+
+func (c *recordingCapture) Open(conn capture.Conn) (capture.Stream, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.conns = append(c.conns, conn)
+	return c, nil
+}
+
+func (c *recordingCapture) Write(direction capture.Direction, data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if direction == capture.Sent {
+		c.sent.Write(data)
+	} else {
+		c.received.Write(data)
+	}
+}
+
+func (c *recordingCapture) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed++
+	return nil
+}
+
+func TestTunnelCapture(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	target := newEchoServer(t)
+	defer target.Close()
+
+	recording := &recordingCapture{}
+	tunnel, err := New(Options{
+		Hops:         StaticHops(Hop{Username: "test", Signer: signer, Address: server.Addr().String()}),
+		Forwards:     []Forward{{Local: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, Remote: target.Addr()}},
+		DrainTimeout: time.Second,
+		Capture:      recording,
+	})
+	if !assert.Nil(t, err) || !assert.Nil(t, tunnel.Start(context.Background())) {
+		return
+	}
+
+	conn, err := net.Dial("tcp", tunnel.Addr().String())
+	if assert.Nil(t, err) {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		assert.Nil(t, echo(conn, "hello"))
+		assert.Nil(t, echo(conn, "world"))
+		conn.Close()
+	}
+
+	assert.Nil(t, tunnel.Close())
+
+	recording.mutex.Lock()
+	defer recording.mutex.Unlock()
+
+	if assert.Len(t, recording.conns, 1) {
+		assert.Equal(t, uint64(1), recording.conns[0].ID)
+		assert.Equal(t, target.Addr().String(), recording.conns[0].Remote.String())
+		assert.Equal(t, conn.LocalAddr().String(), recording.conns[0].Peer.String())
+	}
+	assert.Equal(t, "helloworld", recording.sent.String())
+	assert.Equal(t, "helloworld", recording.received.String())
+	assert.Equal(t, 1, recording.closed)
+}
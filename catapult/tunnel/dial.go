@@ -0,0 +1,104 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ContextDialer dials connections that can be cancelled with a context.  It is
+// implemented by *net.Dialer as well as *Tunnel, which allows using a tunnel
+// wherever a dialer is expected.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DialContext connects to the address, which is resolved by the server,
+// through the tunnel's SSH connection.  It waits for the connection to be
+// re-established if it is currently down, or established if it is idle, until
+// the context is done.  No local listener is involved.  The connection keeps
+// the tunnel from becoming idle until it is closed.
+func (t *Tunnel) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	running := t.running()
+	if running == nil || running.Err() != nil {
+		return nil, ErrClosed
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(running, cancel)
+	defer stop()
+
+	t.idle.hold()
+	var conn net.Conn
+	var err error
+	if t.options.Dialer != nil {
+		conn, err = t.options.Dialer.DialContext(ctx, network, address)
+	} else if client := t.conn.current(ctx); client != nil {
+		conn, err = dialClient(ctx, client, network, address)
+	} else {
+		err = ctx.Err()
+	}
+	if err != nil {
+		t.idle.release()
+		if ctx.Err() != nil {
+			if running.Err() != nil {
+				return nil, ErrClosed
+			}
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	if t.idle == nil {
+		return conn, nil
+	}
+
+	return &heldConn{Conn: conn, release: t.idle.release}, nil
+}
+
+// dialClient connects to the address through the SSH client, giving up when
+// the context is done first.  A failure to connect is returned as a *DialError.
+func dialClient(ctx context.Context, client *ssh.Client, network, address string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	dialed := make(chan result, 1)
+	go func() {
+		conn, err := client.Dial(network, address)
+		dialed <- result{conn, err}
+	}()
+
+	select {
+	case r := <-dialed:
+		if r.err != nil {
+			return nil, &DialError{Network: network, Address: address, Err: r.err}
+		}
+		return r.conn, nil
+	case <-ctx.Done():
+		go func() {
+			if r := <-dialed; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// HTTPClient returns an HTTP client sending every request to the remote
+// address through the tunnel, whatever the host in the request URL.  This
+// allows calling an API served on a Unix domain socket of the server, such as
+// the Docker daemon's /var/run/docker.sock, with URLs like
+// http://docker/containers/json.
+func (t *Tunnel) HTTPClient(remote net.Addr) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return t.DialContext(ctx, remote.Network(), remote.String())
+			},
+		},
+	}
+}
@@ -0,0 +1,209 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTunnelHTTPClient(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "catapult")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := &net.UnixAddr{Name: filepath.Join(dir, "docker.sock"), Net: "unix"}
+	listener, err := net.Listen(socket.Network(), socket.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+
+	tunnel, err := New(Options{
+		Hops: StaticHops(Hop{Username: "test", Signer: signer, Address: server.Addr().String()}),
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	_, err = tunnel.DialContext(context.Background(), socket.Network(), socket.String())
+	assert.Equal(t, ErrClosed, err)
+
+	if !assert.Nil(t, tunnel.Start(context.Background())) {
+		return
+	}
+	assert.Nil(t, tunnel.Addr())
+
+	client := tunnel.HTTPClient(socket)
+	response, err := client.Get("http://docker/containers/json")
+	if assert.Nil(t, err) {
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, "GET /containers/json", string(body))
+	}
+
+	_, err = tunnel.DialContext(context.Background(), "unix", filepath.Join(dir, "missing.sock"))
+	assert.IsType(t, &DialError{}, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = tunnel.DialContext(ctx, socket.Network(), socket.String())
+	assert.Equal(t, context.Canceled, err)
+
+	client.CloseIdleConnections()
+	assert.Nil(t, tunnel.Close())
+
+	_, err = tunnel.DialContext(context.Background(), socket.Network(), socket.String())
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestTunnelDialer(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	testcases := []struct {
+		remote net.Addr
+
+		expected interface{}
+	}{
+		// Connections are opened by the dialer, without any SSH connection
+		{
+			remote: target.Addr(),
+		},
+		// Remote end unreachable through the dialer is reported on start
+		{
+			remote:   closed.Addr(),
+			expected: &DialError{},
+		},
+	}
+
+	for _, testcase := range testcases {
+		tunnel, err := New(Options{
+			Dialer:   &net.Dialer{},
+			Forwards: []Forward{{Local: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, Remote: testcase.remote}},
+		})
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		err = tunnel.Start(context.Background())
+		if testcase.expected != nil {
+			assert.IsType(t, testcase.expected, err)
+			continue
+		}
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		conn, err := net.Dial("tcp", tunnel.Addr().String())
+		if assert.Nil(t, err) {
+			assert.Nil(t, echo(conn, "hello"))
+			conn.Close()
+		}
+
+		conn, err = tunnel.DialContext(context.Background(), "tcp", target.Addr().String())
+		if assert.Nil(t, err) {
+			assert.Nil(t, echo(conn, "hello"))
+			conn.Close()
+		}
+
+		tunnel.Close()
+	}
+}
+
+// stallingDialer dials through a net.Dialer, apart from the dial with the
+// provided number, counted from 1, which waits for its context to be done.
+type stallingDialer struct {
+	mutex sync.Mutex
+	calls int
+	stall int
+}
+
+func (d *stallingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mutex.Lock()
+	d.calls++
+	stall := d.calls == d.stall
+	d.mutex.Unlock()
+
+	if stall {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	return (&net.Dialer{}).DialContext(ctx, network, address)
+}
+
+func TestTunnelStalledDial(t *testing.T) {
+	target := newEchoServer(t)
+	defer target.Close()
+
+	// The first dial is the probe made by Start, the second one that of the
+	// first connection.
+	metrics := &recordingMetrics{}
+	tunnel, err := New(Options{
+		Dialer:       &stallingDialer{stall: 2},
+		Forwards:     []Forward{{Local: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, Remote: target.Addr()}},
+		DrainTimeout: time.Second,
+		Metrics:      metrics,
+	})
+	if !assert.Nil(t, err) || !assert.Nil(t, tunnel.Start(context.Background())) {
+		return
+	}
+
+	stalled, err := net.Dial("tcp", tunnel.Addr().String())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer stalled.Close()
+
+	// The connection that follows is forwarded regardless.
+	conn, err := net.Dial("tcp", tunnel.Addr().String())
+	if assert.Nil(t, err) {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		assert.Nil(t, echo(conn, "hello"))
+		conn.Close()
+	}
+
+	// The stalled dial is given up on shutdown.
+	closed := make(chan error, 1)
+	go func() { closed <- tunnel.Close() }()
+	select {
+	case err := <-closed:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Error("tunnel did not shut down")
+	}
+
+	// Giving up on the dial is not a failure to reach the remote end.
+	metrics.mutex.Lock()
+	assert.Equal(t, 0, metrics.failed)
+	metrics.mutex.Unlock()
+}
@@ -0,0 +1,90 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrDrainTimeout is returned by Wait when connections were still active once
+// the drain timeout elapsed and had to be cut.
+var ErrDrainTimeout = errors.New("active connections did not finish before the drain timeout")
+
+// ErrClosed is returned when dialing through a tunnel that is not started or
+// has shut down.
+var ErrClosed = errors.New("tunnel is closed")
+
+// asDialError returns the error of dialing the address as a *DialError, unless
+// it already is one.
+func asDialError(addr net.Addr, err error) error {
+	var dialErr *DialError
+	if errors.As(err, &dialErr) {
+		return err
+	}
+
+	return &DialError{Network: addr.Network(), Address: addr.String(), Err: err}
+}
+
+// ErrPeerCredentials is returned by PeerUID on platforms where the kernel does
+// not report the peer credentials of Unix domain socket connections.
+var ErrPeerCredentials = errors.New("peer credentials are not supported on this platform")
+
+// ErrRemoteUnreachable is wrapped in the *DialError returned by Start when the
+// remote end of a forward cannot be reached from the server, such as a Unix
+// domain socket that does not exist there.
+var ErrRemoteUnreachable = errors.New("remote end of the forward cannot be reached from the server")
+
+// unreachable returns the error of probing the remote address of a forward.
+func unreachable(remote net.Addr, err error) error {
+	return &DialError{Network: remote.Network(), Address: remote.String(), Err: fmt.Errorf("%w: %w", ErrRemoteUnreachable, err)}
+}
+
+// AuthError is returned when a server rejects the signed certificate, or
+// presents a host key that is not trusted, during the SSH handshake.
+type AuthError struct {
+	Server string
+	Err    error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("failed to authenticate with server %s: %s", e.Server, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// DialError is returned when a server or the remote end of a forward cannot
+// be reached.
+type DialError struct {
+	Network string
+	Address string
+	Err     error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("failed to connect to %s:%s: %s", e.Network, e.Address, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// ListenError is returned when the listener for the local end of a forward
+// cannot be opened.
+type ListenError struct {
+	Network string
+	Address string
+	Err     error
+}
+
+func (e *ListenError) Error() string {
+	return fmt.Sprintf("failed to open listener socket %s:%s for local end of tunnel: %s", e.Network, e.Address, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ListenError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,191 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/marcboudreau/go-devops-talk/catapult/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+// handshakeTimeout bounds the SSH handshake with every hop, unless the context
+// of the connection attempt is done first.
+const handshakeTimeout = 30 * time.Second
+
+// dialTimeout bounds the connection with every hop, unless the context of the
+// connection attempt is done first.  It is a variable so that tests can
+// shorten it.
+var dialTimeout = 30 * time.Second
+
+// Hop describes one SSH server along the path to the destination server.  The
+// Address is only resolved by the previous hop, which allows reaching servers
+// whose names are only known to the bastions in front of them.
+type Hop struct {
+	Username string
+	Signer   ssh.Signer
+	Address  string
+
+	// HostKeyCallback verifies the host key presented by the server.  When nil,
+	// any host key is accepted.
+	HostKeyCallback ssh.HostKeyCallback
+}
+
+func (h Hop) clientConfig() *ssh.ClientConfig {
+	hostKeyCallback := h.HostKeyCallback
+	if hostKeyCallback == nil {
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+
+	return &ssh.ClientConfig{
+		User: h.Username,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(h.Signer),
+		},
+		HostKeyCallback: hostKeyCallback,
+	}
+}
+
+// StaticHops returns a HopsFunc always returning the provided hops, for
+// signers whose certificate does not need to be renewed.
+func StaticHops(hops ...Hop) HopsFunc {
+	return func(context.Context) ([]Hop, error) {
+		return hops, nil
+	}
+}
+
+// Connect establishes an SSH connection with the last of the provided hops.
+// Every hop but the first is reached by dialing it through the connection
+// established with the hop before it.  Closing the returned client closes the
+// connections with all of the intermediate hops.
+//
+// An *AuthError is returned when a hop rejects the credentials or presents an
+// untrusted host key, and a *DialError when it cannot be reached or the SSH
+// handshake with it fails otherwise.  Both are bounded in time.
+func Connect(hops []Hop) (*ssh.Client, error) {
+	return connectHops(context.Background(), nil, hops)
+}
+
+// connectHops implements Connect, recording a span for dialing and for
+// handshaking with every hop.
+func connectHops(ctx context.Context, tracer *trace.Tracer, hops []Hop) (*ssh.Client, error) {
+	if len(hops) == 0 {
+		return nil, errors.New("no server provided")
+	}
+
+	var dialer net.Dialer
+	conn, err := dial(ctx, tracer, hops[0], dialer.DialContext)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := handshake(ctx, tracer, conn, hops[0])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hop := range hops[1:] {
+		previous := client
+		conn, err := dial(ctx, tracer, hop, func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialClient(ctx, previous, network, address)
+		})
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+
+		next, err := handshake(ctx, tracer, conn, hop)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+
+		go closeWith(client, next)
+		client = next
+	}
+
+	return client, nil
+}
+
+// dial opens a connection with the hop using the provided dial function,
+// giving up after dialTimeout or once the context is done.
+func dial(ctx context.Context, tracer *trace.Tracer, hop Hop, dial func(ctx context.Context, network, address string) (net.Conn, error)) (net.Conn, error) {
+	_, span := tracer.Start(ctx, "ssh.dial", trace.String("server", hop.Address))
+	defer span.Finish()
+
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	conn, err := dial(ctx, "tcp", hop.Address)
+	if err != nil {
+		var dialErr *DialError
+		if !errors.As(err, &dialErr) {
+			err = &DialError{Network: "tcp", Address: hop.Address, Err: err}
+		}
+		span.RecordError(err)
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// handshake establishes an SSH connection with the hop over the provided
+// connection.  The connection is closed, failing the handshake, if it does not
+// complete within handshakeTimeout or before the context is done.  Closing
+// works for the channels reaching the inner hops too, which do not support
+// deadlines.
+func handshake(ctx context.Context, tracer *trace.Tracer, conn net.Conn, hop Hop) (*ssh.Client, error) {
+	_, span := tracer.Start(ctx, "ssh.handshake", trace.String("server", hop.Address), trace.String("user", hop.Username))
+	defer span.Finish()
+
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+
+	// The SSH package only reports the failure as text, so remember whether
+	// the host key was the one rejected.
+	config := hop.clientConfig()
+	var untrusted bool
+	verify := config.HostKeyCallback
+	config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := verify(hostname, remote, key)
+		untrusted = err != nil
+		return err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, hop.Address, config)
+	if !stop() {
+		// The connection was closed, whether or not the handshake had
+		// completed by then, so the server did not answer in time.
+		if err == nil {
+			c.Close()
+		}
+		err = &DialError{Network: "tcp", Address: hop.Address, Err: fmt.Errorf("SSH handshake did not complete: %w", ctx.Err())}
+		span.RecordError(err)
+		return nil, err
+	}
+	if err != nil {
+		conn.Close()
+		if untrusted || strings.Contains(err.Error(), "ssh: unable to authenticate") {
+			err = &AuthError{Server: hop.Address, Err: err}
+		} else {
+			err = &DialError{Network: "tcp", Address: hop.Address, Err: err}
+		}
+		span.RecordError(err)
+		return nil, err
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// closeWith closes the previous hop's client once the next hop's client, which
+// is layered on top of it, has been closed.
+func closeWith(previous, next *ssh.Client) {
+	next.Wait()
+	previous.Close()
+}
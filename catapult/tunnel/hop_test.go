@@ -0,0 +1,360 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestConnect(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	bastion := newTestServer(t)
+	defer bastion.Close()
+
+	inner := newTestServer(t)
+	defer inner.Close()
+
+	target := newEchoServer(t)
+	defer target.Close()
+
+	testcases := []struct {
+		hops []Hop
+
+		fails bool
+	}{
+		// No hops
+		{
+			fails: true,
+		},
+		// Unreachable server
+		{
+			hops:  []Hop{{Username: "test", Signer: signer, Address: "127.0.0.1:1"}},
+			fails: true,
+		},
+		// Unreachable server behind a jump host
+		{
+			hops: []Hop{
+				{Username: "test", Signer: signer, Address: bastion.Addr().String()},
+				{Username: "test", Signer: signer, Address: "127.0.0.1:1"},
+			},
+			fails: true,
+		},
+		// Direct connection
+		{
+			hops: []Hop{{Username: "test", Signer: signer, Address: inner.Addr().String()}},
+		},
+		// Connection through a jump host
+		{
+			hops: []Hop{
+				{Username: "bastion", Signer: signer, Address: bastion.Addr().String()},
+				{Username: "test", Signer: signer, Address: inner.Addr().String()},
+			},
+		},
+		// Connection through two jump hosts
+		{
+			hops: []Hop{
+				{Username: "bastion", Signer: signer, Address: bastion.Addr().String()},
+				{Username: "bastion", Signer: signer, Address: bastion.Addr().String()},
+				{Username: "test", Signer: signer, Address: inner.Addr().String()},
+			},
+		},
+	}
+
+	for _, testcase := range testcases {
+		client, err := Connect(testcase.hops)
+		if testcase.fails {
+			assert.NotNil(t, err)
+			assert.Nil(t, client)
+			continue
+		}
+
+		if assert.Nil(t, err) && assert.NotNil(t, client) {
+			conn, err := client.Dial("tcp", target.Addr().String())
+			if assert.Nil(t, err) {
+				fmt.Fprint(conn, "hello")
+				conn.(interface{ CloseWrite() error }).CloseWrite()
+
+				reply, err := ioutil.ReadAll(conn)
+				assert.Nil(t, err)
+				assert.Equal(t, "hello", string(reply))
+				conn.Close()
+			}
+
+			client.Close()
+		}
+	}
+}
+
+func TestConnectSilentServer(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	bastion := newTestServer(t)
+	defer bastion.Close()
+
+	// The silent server accepts connections but never starts the SSH
+	// handshake, like a black-holed bastion.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	testcases := []struct {
+		hops []Hop
+	}{
+		// Silent first hop
+		{
+			hops: []Hop{{Username: "test", Signer: signer, Address: silent.Addr().String()}},
+		},
+		// Silent hop behind a jump host
+		{
+			hops: []Hop{
+				{Username: "bastion", Signer: signer, Address: bastion.Addr().String()},
+				{Username: "test", Signer: signer, Address: silent.Addr().String()},
+			},
+		},
+	}
+
+	for _, testcase := range testcases {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		started := time.Now()
+		client, err := connectHops(ctx, nil, testcase.hops)
+		cancel()
+
+		assert.Nil(t, client)
+		var dialErr *DialError
+		assert.True(t, errors.As(err, &dialErr), "unexpected error %v", err)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error %v", err)
+		assert.True(t, time.Since(started) < 5*time.Second)
+	}
+}
+
+func TestConnectBlackholedHop(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	// The blackholed bastion completes the SSH handshake but never answers
+	// the requests to open channels, like a bastion whose route to the inner
+	// hop drops every packet.
+	bastion := newTestListener(t, func(conn net.Conn, config *ssh.ServerConfig) {
+		serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		defer serverConn.Close()
+
+		go ssh.DiscardRequests(reqs)
+		for range chans {
+		}
+	})
+	defer bastion.Close()
+
+	defer func(timeout time.Duration) { dialTimeout = timeout }(dialTimeout)
+	dialTimeout = 200 * time.Millisecond
+
+	started := time.Now()
+	client, err := Connect([]Hop{
+		{Username: "bastion", Signer: signer, Address: bastion.Addr().String()},
+		{Username: "test", Signer: signer, Address: "10.0.0.1:22"},
+	})
+
+	assert.Nil(t, client)
+	var dialErr *DialError
+	assert.True(t, errors.As(err, &dialErr), "unexpected error %v", err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error %v", err)
+	assert.True(t, time.Since(started) < 5*time.Second)
+}
+
+func TestConnectHandshakeErrors(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	testcases := []struct {
+		serve func(conn net.Conn, config *ssh.ServerConfig)
+
+		expected interface{}
+	}{
+		// Server closes the connection in the middle of the handshake
+		{
+			serve: func(conn net.Conn, config *ssh.ServerConfig) {
+				conn.Read(make([]byte, 1))
+				conn.Close()
+			},
+			expected: &DialError{},
+		},
+		// Server rejects the certificate
+		{
+			serve: func(conn net.Conn, config *ssh.ServerConfig) {
+				rejecting := *config
+				rejecting.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+					return nil, errors.New("certificate not trusted")
+				}
+				serveTestConn(conn, &rejecting)
+			},
+			expected: &AuthError{},
+		},
+	}
+
+	for _, testcase := range testcases {
+		server := newTestListener(t, testcase.serve)
+
+		client, err := Connect([]Hop{{Username: "test", Signer: signer, Address: server.Addr().String()}})
+		assert.Nil(t, client)
+		assert.IsType(t, testcase.expected, err)
+
+		server.Close()
+	}
+}
+
+// newTestServer starts an SSH server that accepts any public key and handles
+// direct-tcpip and direct-streamlocal channels by dialing the requested
+// address.
+func newTestServer(t *testing.T) net.Listener {
+	return newTestListener(t, serveTestConn)
+}
+
+// newTestListener starts a server handing every connection to serve, along
+// with an SSH server configuration that accepts any public key.
+func newTestListener(t *testing.T, serve func(conn net.Conn, config *ssh.ServerConfig)) net.Listener {
+	hostKey, err := ssh.ParsePrivateKey([]byte(testAlternatePrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go serve(conn, config)
+		}
+	}()
+
+	return listener
+}
+
+func serveTestConn(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer serverConn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		var network, address string
+
+		switch newChannel.ChannelType() {
+		case "direct-tcpip":
+			var payload struct {
+				Host       string
+				Port       uint32
+				OriginHost string
+				OriginPort uint32
+			}
+			if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+				newChannel.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			network, address = "tcp", net.JoinHostPort(payload.Host, fmt.Sprint(payload.Port))
+		case "direct-streamlocal@openssh.com":
+			var payload struct {
+				SocketPath string
+				Reserved0  string
+				Reserved1  uint32
+			}
+			if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+				newChannel.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			network, address = "unix", payload.SocketPath
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+
+		target, err := net.Dial(network, address)
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+
+		go func() {
+			io.Copy(channel, target)
+			channel.CloseWrite()
+		}()
+		go func() {
+			io.Copy(target, channel)
+			target.(interface{ CloseWrite() error }).CloseWrite()
+		}()
+	}
+}
+
+// newEchoServer starts a TCP server that writes back everything it reads.
+func newEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return listener
+}
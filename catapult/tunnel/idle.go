@@ -0,0 +1,130 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// idleMonitor calls a function once nothing has used the tunnel for a given
+// time.  A nil *idleMonitor never does.
+type idleMonitor struct {
+	timeout time.Duration
+	onIdle  func()
+
+	mutex sync.Mutex
+	users int
+	timer *time.Timer
+	// generation invalidates timers that fired while being stopped.
+	generation int
+}
+
+// newIdleMonitor returns an idle monitor calling onIdle after the timeout, or
+// nil when the timeout is not positive.  It is not armed until arm is called.
+func newIdleMonitor(timeout time.Duration, onIdle func()) *idleMonitor {
+	if timeout <= 0 {
+		return nil
+	}
+
+	return &idleMonitor{timeout: timeout, onIdle: onIdle}
+}
+
+// hold records a user of the tunnel, which prevents it from becoming idle
+// until released.
+func (m *idleMonitor) hold() {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.users++
+	m.stopLocked()
+}
+
+// release records that a user of the tunnel is done with it, arming the
+// monitor if it was the last one.
+func (m *idleMonitor) release() {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.users--
+	if m.users == 0 {
+		m.armLocked()
+	}
+}
+
+// arm starts counting down to onIdle, unless the tunnel is in use.
+func (m *idleMonitor) arm() {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.users == 0 {
+		m.armLocked()
+	}
+}
+
+// stop cancels the count down until the monitor is armed again.
+func (m *idleMonitor) stop() {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.stopLocked()
+}
+
+func (m *idleMonitor) armLocked() {
+	m.stopLocked()
+
+	generation := m.generation
+	m.timer = time.AfterFunc(m.timeout, func() {
+		m.mutex.Lock()
+		expired := generation == m.generation && m.users == 0
+		if expired {
+			m.timer = nil
+		}
+		m.mutex.Unlock()
+
+		if expired {
+			m.onIdle()
+		}
+	})
+}
+
+func (m *idleMonitor) stopLocked() {
+	m.generation++
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+}
+
+// heldConn releases its hold on the idle monitor once closed.
+type heldConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *heldConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// CloseWrite closes the write side of the underlying connection, which keeps
+// holding the idle monitor until closed.
+func (c *heldConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,113 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTunnelIdle(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	target := newEchoServer(t)
+	defer target.Close()
+
+	testcases := []struct {
+		lazy          bool
+		closeWhenIdle bool
+		connections   int
+
+		expectedStates []State
+		expectedCalls  int32
+	}{
+		// Connection is established on demand and closed once idle
+		{
+			lazy:        true,
+			connections: 2,
+			expectedStates: []State{
+				Idle, Ready,
+				Connecting, Connected, Idle,
+				Connecting, Connected, Idle,
+			},
+			expectedCalls: 2,
+		},
+		// Connection established on start is closed once idle
+		{
+			connections: 2,
+			expectedStates: []State{
+				Connecting, Connected, Ready, Idle,
+				Connecting, Connected, Idle,
+			},
+			expectedCalls: 2,
+		},
+		// Tunnel that is never used shuts down without connecting
+		{
+			lazy:           true,
+			closeWhenIdle:  true,
+			expectedStates: []State{Idle, Ready, Closed},
+		},
+	}
+
+	for _, testcase := range testcases {
+		var calls atomic.Int32
+		hops := func(context.Context) ([]Hop, error) {
+			calls.Add(1)
+			return []Hop{{Username: "test", Signer: signer, Address: server.Addr().String()}}, nil
+		}
+
+		tunnel, err := New(Options{
+			Hops:           hops,
+			Forwards:       []Forward{{Local: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, Remote: target.Addr()}},
+			Lazy:           testcase.lazy,
+			IdleDisconnect: 200 * time.Millisecond,
+			CloseWhenIdle:  testcase.closeWhenIdle,
+			DrainTimeout:   time.Second,
+		})
+		if !assert.Nil(t, err) || !assert.Nil(t, tunnel.Start(context.Background())) {
+			continue
+		}
+
+		var states []State
+		waitFor := func(state State) {
+			for {
+				select {
+				case event := <-tunnel.Events():
+					states = append(states, event.State)
+					if event.State == state {
+						return
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("tunnel did not become %s", state)
+				}
+			}
+		}
+		waitFor(Ready)
+
+		for i := 0; i < testcase.connections; i++ {
+			conn, err := net.Dial("tcp", tunnel.Addr().String())
+			if assert.Nil(t, err) {
+				assert.Nil(t, echo(conn, "hello"))
+				conn.Close()
+			}
+			waitFor(Idle)
+		}
+
+		if testcase.closeWhenIdle {
+			waitFor(Closed)
+		} else {
+			tunnel.Close()
+		}
+
+		assert.Equal(t, testcase.expectedStates, states)
+		assert.Equal(t, testcase.expectedCalls, calls.Load())
+	}
+}
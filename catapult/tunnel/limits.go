@@ -0,0 +1,130 @@
+package tunnel
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// limiter bounds the number of connections a forward handles concurrently.  A
+// nil limiter imposes no bound.
+type limiter chan struct{}
+
+func newLimiter(max int) limiter {
+	if max <= 0 {
+		return nil
+	}
+
+	return make(limiter, max)
+}
+
+// acquire waits for a slot to be available, until the context is done, in
+// which case it returns false.
+func (l limiter) acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// tryAcquire takes a slot if one is available.
+func (l limiter) tryAcquire() bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees the slot taken by acquire or tryAcquire.
+func (l limiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// watchdog closes a forwarded connection once no data went through it for the
+// idle timeout, or once it has been open for the maximum lifetime.  Zero
+// durations disable the corresponding check.
+type watchdog struct {
+	idleTimeout time.Duration
+	expire      func(reason string)
+
+	mutex        sync.Mutex
+	lastActivity time.Time
+	idleTimer    *time.Timer
+	lifeTimer    *time.Timer
+	stopped      bool
+}
+
+func newWatchdog(idleTimeout, maxLifetime time.Duration, expire func(reason string)) *watchdog {
+	w := &watchdog{
+		idleTimeout:  idleTimeout,
+		expire:       expire,
+		lastActivity: time.Now(),
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if idleTimeout > 0 {
+		w.idleTimer = time.AfterFunc(idleTimeout, w.checkIdle)
+	}
+	if maxLifetime > 0 {
+		w.lifeTimer = time.AfterFunc(maxLifetime, func() { w.expire("maximum lifetime reached") })
+	}
+
+	return w
+}
+
+// touch records activity on the connection.
+func (w *watchdog) touch() {
+	w.mutex.Lock()
+	w.lastActivity = time.Now()
+	w.mutex.Unlock()
+}
+
+// checkIdle expires the connection if it has been idle for the idle timeout,
+// and otherwise checks again once it could have been.
+func (w *watchdog) checkIdle() {
+	w.mutex.Lock()
+	if w.stopped {
+		w.mutex.Unlock()
+		return
+	}
+
+	idle := time.Since(w.lastActivity)
+	if idle < w.idleTimeout {
+		w.idleTimer.Reset(w.idleTimeout - idle)
+		w.mutex.Unlock()
+		return
+	}
+	w.mutex.Unlock()
+
+	w.expire("idle timeout reached")
+}
+
+// stop disables the checks once the connection is done.
+func (w *watchdog) stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.stopped = true
+	if w.idleTimer != nil {
+		w.idleTimer.Stop()
+	}
+	if w.lifeTimer != nil {
+		w.lifeTimer.Stop()
+	}
+}
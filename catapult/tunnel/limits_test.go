@@ -0,0 +1,246 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTunnelLimits(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	target := newEchoServer(t)
+	defer target.Close()
+
+	hops := StaticHops(Hop{Username: "test", Signer: signer, Address: server.Addr().String()})
+
+	testcases := []struct {
+		forward Forward
+
+		// Whether a second connection, opened while the first is active, is
+		// served only once the first is closed, or closed right away.
+		queued   bool
+		rejected bool
+		// Whether the first connection is closed after sitting idle.
+		closed bool
+	}{
+		// Connections beyond the limit wait for a slot
+		{
+			forward: Forward{MaxConnections: 1},
+			queued:  true,
+		},
+		// Connections beyond the limit are rejected
+		{
+			forward:  Forward{MaxConnections: 1, RejectWhenFull: true},
+			rejected: true,
+		},
+		// Idle connections are closed
+		{
+			forward: Forward{IdleTimeout: 100 * time.Millisecond},
+			closed:  true,
+		},
+		// Connections are closed once their lifetime elapses
+		{
+			forward: Forward{MaxLifetime: 100 * time.Millisecond},
+			closed:  true,
+		},
+	}
+
+	for _, testcase := range testcases {
+		forward := testcase.forward
+		forward.Local = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+		forward.Remote = target.Addr()
+
+		tunnel, err := New(Options{Hops: hops, Forwards: []Forward{forward}})
+		if !assert.Nil(t, err) || !assert.Nil(t, tunnel.Start(context.Background())) {
+			continue
+		}
+
+		first, err := net.Dial("tcp", tunnel.Addr().String())
+		if !assert.Nil(t, err) {
+			tunnel.Close()
+			continue
+		}
+		assert.Nil(t, echo(first, "first"))
+
+		second, err := net.Dial("tcp", tunnel.Addr().String())
+		if !assert.Nil(t, err) {
+			first.Close()
+			tunnel.Close()
+			continue
+		}
+
+		switch {
+		case testcase.rejected:
+			_, err := second.Read(make([]byte, 1))
+			assert.Equal(t, io.EOF, err)
+		case testcase.queued:
+			fmt.Fprint(second, "second")
+			second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, err := second.Read(make([]byte, 1))
+			assert.True(t, isTimeout(err))
+
+			first.Close()
+			second.SetReadDeadline(time.Time{})
+			reply := make([]byte, 6)
+			_, err = io.ReadFull(second, reply)
+			assert.Nil(t, err)
+			assert.Equal(t, "second", string(reply))
+		}
+
+		if testcase.closed {
+			first.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, err := first.Read(make([]byte, 1))
+			assert.Equal(t, io.EOF, err)
+		}
+
+		first.Close()
+		second.Close()
+		tunnel.Close()
+	}
+}
+
+func TestWatchdogActivity(t *testing.T) {
+	expired := make(chan string, 1)
+	watchdog := newWatchdog(100*time.Millisecond, 0, func(reason string) {
+		expired <- reason
+	})
+	defer watchdog.stop()
+
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		watchdog.touch()
+	}
+
+	select {
+	case <-expired:
+		t.Fatal("active connection expired")
+	default:
+	}
+
+	select {
+	case reason := <-expired:
+		assert.Equal(t, "idle timeout reached", reason)
+	case <-time.After(time.Second):
+		t.Fatal("idle connection did not expire")
+	}
+}
+
+// echo writes the message to the connection and checks that it is echoed
+// back.
+func echo(conn net.Conn, message string) error {
+	if _, err := fmt.Fprint(conn, message); err != nil {
+		return err
+	}
+
+	reply := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+
+	if string(reply) != message {
+		return fmt.Errorf("expected %q, got %q", message, reply)
+	}
+
+	return nil
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// temporaryError is a temporary failure to accept, such as EMFILE.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// failingListener fails to accept with err the provided number of times
+// before accepting connections.
+type failingListener struct {
+	net.Listener
+	err      error
+	failures atomic.Int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, l.err
+	}
+
+	return l.Listener.Accept()
+}
+
+func TestTunnelAcceptErrors(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	target := newEchoServer(t)
+	defer target.Close()
+
+	hops := StaticHops(Hop{Username: "test", Signer: signer, Address: server.Addr().String()})
+
+	testcases := []struct {
+		err error
+
+		// Whether connections are still forwarded after the failures.
+		served bool
+	}{
+		// Temporary failures are retried
+		{
+			err:    temporaryError{},
+			served: true,
+		},
+		// Permanent failures stop the forward
+		{
+			err: errors.New("listener broken"),
+		},
+	}
+
+	for _, testcase := range testcases {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.Nil(t, err) {
+			continue
+		}
+		failing := &failingListener{Listener: listener, err: testcase.err}
+		failing.failures.Store(3)
+
+		forward := Forward{Listener: failing, Remote: target.Addr()}
+		tunnel, err := New(Options{Hops: hops, Forwards: []Forward{forward}})
+		if !assert.Nil(t, err) || !assert.Nil(t, tunnel.Start(context.Background())) {
+			listener.Close()
+			continue
+		}
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if assert.Nil(t, err) {
+			conn.SetDeadline(time.Now().Add(time.Second))
+			err = echo(conn, "hello")
+			if testcase.served {
+				assert.Nil(t, err)
+			} else {
+				assert.True(t, isTimeout(err))
+			}
+			conn.Close()
+		}
+
+		tunnel.Close()
+	}
+}
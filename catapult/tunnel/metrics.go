@@ -0,0 +1,63 @@
+package tunnel
+
+import "io"
+
+// Metrics receives measurements of a tunnel's activity.  Its methods are
+// called concurrently and must not block.  The local address of the forwards
+// they are passed is the one the listener is bound to, even when an ephemeral
+// port was requested.
+type Metrics interface {
+	// StateChanged is called on every state transition of the tunnel.
+	StateChanged(state State)
+
+	// ConnectionOpened is called when a connection is accepted on the local
+	// address of the forward.
+	ConnectionOpened(forward Forward)
+
+	// ConnectionRejected is called when a connection accepted on the local
+	// address of the forward is closed because too many are active or because
+	// its peer is not allowed to use the forward.
+	ConnectionRejected(forward Forward)
+
+	// ConnectionFailed is called when the remote end of the forward cannot be
+	// reached for an accepted connection.
+	ConnectionFailed(forward Forward)
+
+	// ConnectionClosed is called once both directions of an accepted
+	// connection are done, or once it is closed after failing to reach the
+	// remote end.
+	ConnectionClosed(forward Forward)
+
+	// BytesSent is called as data is forwarded from the local end of the
+	// forward to the remote end.
+	BytesSent(forward Forward, n int64)
+
+	// BytesReceived is called as data is forwarded from the remote end of the
+	// forward to the local end.
+	BytesReceived(forward Forward, n int64)
+}
+
+type noMetrics struct{}
+
+func (noMetrics) StateChanged(State)           {}
+func (noMetrics) ConnectionOpened(Forward)     {}
+func (noMetrics) ConnectionRejected(Forward)   {}
+func (noMetrics) ConnectionFailed(Forward)     {}
+func (noMetrics) ConnectionClosed(Forward)     {}
+func (noMetrics) BytesSent(Forward, int64)     {}
+func (noMetrics) BytesReceived(Forward, int64) {}
+
+// meteredWriter reports the data written through it.
+type meteredWriter struct {
+	io.Writer
+	written func(b []byte)
+}
+
+func (w meteredWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	if n > 0 {
+		w.written(b[:n])
+	}
+
+	return n, err
+}
@@ -0,0 +1,35 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// PeerUID returns the user ID of the process connected to the other end of a
+// Unix domain socket connection, as reported by the kernel.
+func PeerUID(conn net.Conn) (int, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, errors.New("not a Unix domain socket connection")
+	}
+
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+
+	return int(ucred.Uid), nil
+}
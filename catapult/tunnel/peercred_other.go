@@ -0,0 +1,11 @@
+//go:build !linux
+
+package tunnel
+
+import "net"
+
+// PeerUID is not supported on this platform, so connections are refused when
+// allowed users are configured.
+func PeerUID(conn net.Conn) (int, error) {
+	return 0, ErrPeerCredentials
+}
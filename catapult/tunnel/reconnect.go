@@ -0,0 +1,353 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/marcboudreau/go-devops-talk/catapult/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+// State describes the state of a tunnel and of its underlying SSH connection.
+type State int
+
+const (
+	// Connecting indicates that the SSH connection is being established.
+	Connecting State = iota
+	// Connected indicates that the SSH connection is established.
+	Connected
+	// Ready indicates that the local listeners accept connections.
+	Ready
+	// Disconnected indicates that the SSH connection was lost and will be
+	// re-established.
+	Disconnected
+	// Closed indicates that the tunnel has shut down.
+	Closed
+	// Idle indicates that the SSH connection is not established because
+	// nothing uses the tunnel.  It is established on demand.
+	Idle
+)
+
+func (s State) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Ready:
+		return "ready"
+	case Disconnected:
+		return "disconnected"
+	case Closed:
+		return "closed"
+	case Idle:
+		return "idle"
+	}
+
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// HopsFunc returns the hops to traverse to reach the server.  It is called
+// every time the SSH connection needs to be (re-)established, which gives it
+// the opportunity to re-sign certificates that have expired.
+type HopsFunc func(ctx context.Context) ([]Hop, error)
+
+// connection maintains an SSH connection with the server, sending keepalive
+// requests over it and re-establishing it whenever it is lost.
+type connection struct {
+	hops            HopsFunc
+	hostKeyCallback ssh.HostKeyCallback
+	keepalive       time.Duration
+	logger          *slog.Logger
+	tracer          *trace.Tracer
+	report          func(State, error)
+
+	mutex  sync.Mutex
+	client *ssh.Client
+	ready  chan struct{}
+
+	// wake is closed to establish the connection while it is idle, and nil
+	// otherwise.
+	wake chan struct{}
+	// suspended is the client closed by suspend, which maintain must not
+	// replace until the connection is needed again.
+	suspended *ssh.Client
+}
+
+func newConnection(options Options, report func(State, error)) *connection {
+	if report == nil {
+		report = func(State, error) {}
+	}
+
+	return &connection{
+		hops:            options.Hops,
+		hostKeyCallback: options.HostKeyCallback,
+		keepalive:       options.Keepalive,
+		logger:          options.logger(),
+		tracer:          options.Tracer,
+		report:          report,
+		ready:           make(chan struct{}),
+	}
+}
+
+// connect establishes the SSH connection with the server.  Hops without a host
+// key callback of their own use the connection's.
+func (c *connection) connect(ctx context.Context) (*ssh.Client, error) {
+	ctx, span := c.tracer.Start(ctx, "ssh.connect")
+	defer span.Finish()
+
+	hops, err := c.hops(ctx)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	if c.hostKeyCallback != nil {
+		withCallback := make([]Hop, len(hops))
+		for i, hop := range hops {
+			if hop.HostKeyCallback == nil {
+				hop.HostKeyCallback = c.hostKeyCallback
+			}
+			withCallback[i] = hop
+		}
+		hops = withCallback
+	}
+
+	client, err := connectHops(ctx, c.tracer, hops)
+	span.RecordError(err)
+
+	return client, err
+}
+
+// maintain watches the established client and reconnects whenever it dies,
+// until the context is done.  The client in use at that point is left open.
+// While the connection is idle, which it is from the start when client is nil,
+// it is only re-established once current is called.
+func (c *connection) maintain(ctx context.Context, client *ssh.Client) {
+	for {
+		if client == nil {
+			if client = c.resume(ctx); client == nil {
+				return
+			}
+			c.setState(client, Connected, nil)
+		}
+
+		done := make(chan struct{})
+		go c.sendKeepalives(client, done)
+
+		err := client.Wait()
+		close(done)
+		if ctx.Err() != nil {
+			return
+		}
+		client.Close()
+
+		c.mutex.Lock()
+		suspended := c.suspended == client
+		c.suspended = nil
+		c.mutex.Unlock()
+		if suspended {
+			client = nil
+			continue
+		}
+
+		c.setState(nil, Disconnected, err)
+		if client = c.reconnect(ctx); client == nil {
+			return
+		}
+		c.setState(client, Connected, nil)
+	}
+}
+
+// resume waits for the idle connection to be needed and establishes it.  It
+// returns nil if the context is done first.
+func (c *connection) resume(ctx context.Context) *ssh.Client {
+	c.mutex.Lock()
+	wake := c.wake
+	c.mutex.Unlock()
+
+	if wake != nil {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-wake:
+		}
+	}
+
+	return c.reconnect(ctx)
+}
+
+// idle marks the connection, which must not be established, as idle until
+// current is called.
+func (c *connection) idle() {
+	c.mutex.Lock()
+	c.wake = make(chan struct{})
+	c.mutex.Unlock()
+
+	c.report(Idle, nil)
+}
+
+// suspend closes the established client while nothing uses it, leaving the
+// connection idle until current is called.  It does nothing while the
+// connection is down.
+func (c *connection) suspend() {
+	c.mutex.Lock()
+	client := c.client
+	if client == nil {
+		c.mutex.Unlock()
+		return
+	}
+	c.client = nil
+	c.ready = make(chan struct{})
+	c.wake = make(chan struct{})
+	c.suspended = client
+	c.mutex.Unlock()
+
+	// Idle is reported before closing the client, since maintain reports
+	// Connecting once woken, which requires the client to be closed.
+	c.report(Idle, nil)
+	client.Close()
+}
+
+// reconnect retries establishing the SSH connection, waiting an exponentially
+// growing and randomly jittered delay between attempts, until it succeeds or
+// the context is done, in which case it returns nil.
+func (c *connection) reconnect(ctx context.Context) *ssh.Client {
+	delay := minReconnectDelay
+
+	for {
+		c.setState(nil, Connecting, nil)
+
+		client, err := c.connect(ctx)
+		if err == nil {
+			if ctx.Err() != nil {
+				client.Close()
+				return nil
+			}
+			return client
+		}
+
+		wait := jitter(delay)
+		c.logger.Warn("failed to reconnect", "retry_in", wait, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// jitter returns a random duration between half and all of the provided delay.
+func jitter(delay time.Duration) time.Duration {
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// sendKeepalives periodically sends a keepalive request to the server and
+// closes the client if the server fails to reply before the next one is due.
+func (c *connection) sendKeepalives(client *ssh.Client, done <-chan struct{}) {
+	if c.keepalive <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.keepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case <-done:
+			return
+		case err := <-reply:
+			if err != nil {
+				client.Close()
+				return
+			}
+		case <-time.After(c.keepalive):
+			c.logger.Warn("server did not answer keepalive", "server", client.RemoteAddr().String(), "interval", c.keepalive)
+			client.Close()
+			return
+		}
+	}
+}
+
+// setState records the client to use for new connections, which is nil while
+// the connection is down, and reports the state transition.
+func (c *connection) setState(client *ssh.Client, state State, err error) {
+	c.setClient(client)
+	c.report(state, err)
+}
+
+// setClient records the client to use for new connections without reporting
+// a state transition.
+func (c *connection) setClient(client *ssh.Client) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if client != nil && c.client == nil {
+		close(c.ready)
+	} else if client == nil && c.client != nil {
+		c.ready = make(chan struct{})
+	}
+	c.client = client
+}
+
+// current returns the connected client, waiting for the connection to be
+// re-established if it is currently down, or established if it is idle.  It
+// returns nil if the context is done first.
+func (c *connection) current(ctx context.Context) *ssh.Client {
+	for {
+		c.mutex.Lock()
+		client, ready := c.client, c.ready
+		if client == nil && c.wake != nil {
+			close(c.wake)
+			c.wake = nil
+		}
+		c.mutex.Unlock()
+
+		if client != nil {
+			return client
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ready:
+		}
+	}
+}
+
+// close closes the client currently in use, if any.
+func (c *connection) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.client != nil {
+		c.client.Close()
+	}
+}
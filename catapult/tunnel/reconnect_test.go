@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJitter(t *testing.T) {
+	for _, delay := range []time.Duration{0, time.Nanosecond, time.Second, time.Minute} {
+		for i := 0; i < 100; i++ {
+			wait := jitter(delay)
+			assert.True(t, wait >= delay/2, "%s is shorter than half of %s", wait, delay)
+			assert.True(t, wait <= delay, "%s is longer than %s", wait, delay)
+		}
+	}
+}
+
+func TestConnectionReconnects(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	calls := 0
+	hops := func(context.Context) ([]Hop, error) {
+		calls++
+		return []Hop{{Username: "test", Signer: signer, Address: server.Addr().String()}}, nil
+	}
+
+	states := make(chan State, 10)
+	conn := newConnection(Options{Hops: hops, Keepalive: time.Second}, func(state State, err error) {
+		states <- state
+	})
+
+	client, err := conn.connect(context.Background())
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn.setState(client, Connected, nil)
+	go conn.maintain(ctx, client)
+	assert.Equal(t, Connected, <-states)
+	assert.Equal(t, client, conn.current(ctx))
+
+	client.Close()
+	assert.Equal(t, Disconnected, <-states)
+	assert.Equal(t, Connecting, <-states)
+	assert.Equal(t, Connected, <-states)
+
+	reconnected := conn.current(ctx)
+	assert.NotEqual(t, client, reconnected)
+	assert.Equal(t, 2, calls)
+
+	_, _, err = reconnected.SendRequest("keepalive@openssh.com", true, nil)
+	assert.Nil(t, err)
+
+	cancel()
+	conn.close()
+	reconnected.Wait()
+}
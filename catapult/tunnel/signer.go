@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -49,3 +50,27 @@ func CreateSigner(privateKey, certificate io.Reader) (ssh.Signer, error) {
 	// }
 
 }
+
+// CertificateExpired reports whether the provided signer authenticates with a
+// certificate that is no longer valid.  Signers that do not use a certificate
+// never expire.
+func CertificateExpired(signer ssh.Signer) bool {
+	validBefore, ok := CertificateExpiry(signer)
+	if !ok {
+		return false
+	}
+
+	return !time.Now().Before(validBefore)
+}
+
+// CertificateExpiry returns the time at which the certificate the provided
+// signer authenticates with stops being valid.  It returns false when the
+// signer does not use a certificate or when the certificate never expires.
+func CertificateExpiry(signer ssh.Signer) (time.Time, bool) {
+	certificate, ok := signer.PublicKey().(*ssh.Certificate)
+	if !ok || certificate.ValidBefore == ssh.CertTimeInfinity {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(certificate.ValidBefore), 0), true
+}
@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
 )
 
 // These are dummy SSH keys that were generated specifically for testing this code.
@@ -142,6 +143,24 @@ func TestCreateSigner(t *testing.T) {
 	}
 }
 
+func TestCertificateExpired(t *testing.T) {
+	// The test certificate was only valid for a few minutes in January 2019.
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+	assert.True(t, CertificateExpired(signer))
+
+	plainSigner, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+	assert.Nil(t, err)
+	assert.False(t, CertificateExpired(plainSigner))
+
+	validBefore, ok := CertificateExpiry(signer)
+	assert.True(t, ok)
+	assert.Equal(t, 2019, validBefore.Year())
+
+	_, ok = CertificateExpiry(plainSigner)
+	assert.False(t, ok)
+}
+
 type failingReader struct {
 	io.Reader
 }
@@ -0,0 +1,90 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrSocketInUse is returned, wrapped in a *ListenError, when the path of a
+// Unix domain socket listener is already served by another process.
+var ErrSocketInUse = errors.New("socket is in use by another process")
+
+// staleSocketTimeout is the time given to connect to an existing socket file
+// to find out whether another process still serves it.
+const staleSocketTimeout = time.Second
+
+// prepareSocket readies the path of a Unix domain socket listener: it creates
+// its missing parent directories, with the permissions and group implied by
+// the access to the socket, and removes a socket file left behind by a process
+// that did not shut down cleanly.  A socket file some process still accepts
+// connections on is left untouched and ErrSocketInUse is returned.  Abstract
+// sockets, whose name starts with @, have no file and are left as is.
+func prepareSocket(path string, access Access, logger *slog.Logger) error {
+	if path == "" || path[0] == '@' {
+		return nil
+	}
+
+	_, gid, err := access.socketOwnership()
+	if err != nil {
+		return err
+	}
+
+	if err := createSocketDir(filepath.Dir(path), access.socketDirMode(), gid); err != nil {
+		return fmt.Errorf("failed to create socket directory.  Error: %s", err)
+	}
+
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, staleSocketTimeout)
+	if err == nil {
+		conn.Close()
+		return ErrSocketInUse
+	}
+
+	logger.Info("removing stale socket file", "path", path, "error", err)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket file.  Error: %s", err)
+	}
+
+	return nil
+}
+
+// createSocketDir creates the directory and its missing parents with the
+// provided permissions, which are applied regardless of the umask, and group,
+// unless gid is -1.  Existing directories are left as they are.
+func createSocketDir(dir string, mode os.FileMode, gid int) error {
+	if _, err := os.Stat(dir); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := createSocketDir(filepath.Dir(dir), mode, gid); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+
+	if gid != -1 {
+		if err := os.Chown(dir, -1, gid); err != nil {
+			return err
+		}
+	}
+
+	return os.Chmod(dir, mode)
+}
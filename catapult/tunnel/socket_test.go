@@ -0,0 +1,256 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrepareSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catapult")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stale := filepath.Join(dir, "stale.sock")
+	listener, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	served := filepath.Join(dir, "served.sock")
+	listener, err = net.Listen("unix", served)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	regular := filepath.Join(dir, "regular")
+	if err := ioutil.WriteFile(regular, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		path   string
+		access Access
+
+		expectedErr     error
+		expectedFailed  bool
+		expectedExists  bool
+		expectedDirMode os.FileMode
+	}{
+		// Parent directories are created
+		{
+			path:            filepath.Join(dir, "nested", "tunnel.sock"),
+			expectedDirMode: 0700,
+		},
+		// Parent directories can be searched by the group of a socket it can
+		// access
+		{
+			path:            filepath.Join(dir, "shared", "nested", "tunnel.sock"),
+			access:          Access{SocketMode: 0660, SocketGroup: strconv.Itoa(os.Getgid())},
+			expectedDirMode: 0710,
+		},
+		// Parent directories can be searched by others when the socket is
+		// accessible to them
+		{
+			path:            filepath.Join(dir, "public", "tunnel.sock"),
+			access:          Access{SocketMode: 0666},
+			expectedDirMode: 0711,
+		},
+		// Socket file left behind by a crashed process is removed
+		{
+			path:            stale,
+			expectedDirMode: 0700,
+		},
+		// Socket file another process listens on is kept
+		{
+			path:            served,
+			expectedErr:     ErrSocketInUse,
+			expectedFailed:  true,
+			expectedExists:  true,
+			expectedDirMode: 0700,
+		},
+		// Files other than sockets are never removed
+		{
+			path:            regular,
+			expectedFailed:  true,
+			expectedExists:  true,
+			expectedDirMode: 0700,
+		},
+	}
+
+	for _, testcase := range testcases {
+		err := prepareSocket(testcase.path, testcase.access, slog.Default())
+		assert.Equal(t, testcase.expectedFailed, err != nil, "%s: %v", testcase.path, err)
+		if testcase.expectedErr != nil {
+			assert.Equal(t, testcase.expectedErr, err)
+		}
+
+		_, err = os.Lstat(testcase.path)
+		assert.Equal(t, testcase.expectedExists, err == nil, testcase.path)
+
+		info, err := os.Stat(filepath.Dir(testcase.path))
+		if assert.Nil(t, err) {
+			assert.Equal(t, testcase.expectedDirMode, info.Mode().Perm(), testcase.path)
+		}
+	}
+}
+
+func TestTunnelUnixSocket(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	target := newEchoServer(t)
+	defer target.Close()
+
+	dir, err := ioutil.TempDir("", "catapult")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "run", "docker.sock")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	tunnel, err := New(Options{
+		Hops:         StaticHops(Hop{Username: "test", Signer: signer, Address: server.Addr().String()}),
+		Forwards:     []Forward{{Local: &net.UnixAddr{Name: path, Net: "unix"}, Remote: target.Addr(), Access: Access{SocketMode: 0600}}},
+		DrainTimeout: time.Second,
+	})
+	if !assert.Nil(t, err) || !assert.Nil(t, tunnel.Start(context.Background())) {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	conn, err := net.Dial("unix", path)
+	if assert.Nil(t, err) {
+		assert.Nil(t, echo(conn, "hello"))
+		conn.Close()
+	}
+
+	// A second tunnel must not take over, nor remove, the socket in use.
+	second, err := New(Options{
+		Hops:     StaticHops(Hop{Username: "test", Signer: signer, Address: server.Addr().String()}),
+		Forwards: []Forward{{Local: &net.UnixAddr{Name: path, Net: "unix"}, Remote: target.Addr()}},
+	})
+	if assert.Nil(t, err) {
+		err = second.Start(context.Background())
+		assert.True(t, errors.Is(err, ErrSocketInUse), "%v", err)
+		_, err = os.Stat(path)
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, tunnel.Close())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTunnelInheritedListener(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	target := newEchoServer(t)
+	defer target.Close()
+
+	dir, err := ioutil.TempDir("", "catapult")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel, err := New(Options{
+		Hops:         StaticHops(Hop{Username: "test", Signer: signer, Address: server.Addr().String()}),
+		Forwards:     []Forward{{Listener: listener, Remote: target.Addr()}},
+		DrainTimeout: time.Second,
+	})
+	if !assert.Nil(t, err) || !assert.Nil(t, tunnel.Start(context.Background())) {
+		return
+	}
+	assert.Equal(t, listener.Addr(), tunnel.Addr())
+
+	conn, err := net.Dial("unix", path)
+	if assert.Nil(t, err) {
+		assert.Nil(t, echo(conn, "hello"))
+		conn.Close()
+	}
+
+	// The socket file belongs to whoever passed the listener.
+	assert.Nil(t, tunnel.Close())
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+}
+
+func TestListenPrivate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket permissions do not apply on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "catapult")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A socket created as usual gets the permissions resulting from the
+	// umask.
+	public, err := net.Listen("unix", filepath.Join(dir, "public.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	publicInfo, err := os.Stat(filepath.Join(dir, "public.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, mode, err := ListenPrivate("unix", filepath.Join(dir, "private.sock"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(filepath.Join(dir, "private.sock"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	}
+	assert.Equal(t, publicInfo.Mode().Perm(), mode)
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+
+package tunnel
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// umaskMutex serializes the temporary changes of the process's umask.
+var umaskMutex sync.Mutex
+
+// ListenPrivate listens on a Unix domain socket whose file is created with
+// access for the current user only, so that nobody else can connect before
+// its ownership and permissions are applied.  It also returns the permissions
+// the file would have had under the process's umask, which are zero for an
+// abstract socket as it has no file.
+//
+// The umask being shared by the whole process, files created by other
+// goroutines meanwhile are restricted to the current user as well.
+func ListenPrivate(network, address string) (net.Listener, os.FileMode, error) {
+	if address == "" || address[0] == '@' {
+		listener, err := net.Listen(network, address)
+		return listener, 0, err
+	}
+
+	umaskMutex.Lock()
+	defer umaskMutex.Unlock()
+
+	umask := syscall.Umask(0077)
+	defer syscall.Umask(umask)
+
+	listener, err := net.Listen(network, address)
+	return listener, os.FileMode(0777 &^ umask), err
+}
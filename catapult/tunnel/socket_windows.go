@@ -0,0 +1,13 @@
+package tunnel
+
+import (
+	"net"
+	"os"
+)
+
+// ListenPrivate listens on a Unix domain socket.  File permissions do not
+// control access to sockets on Windows, so no permissions are returned.
+func ListenPrivate(network, address string) (net.Listener, os.FileMode, error) {
+	listener, err := net.Listen(network, address)
+	return listener, 0, err
+}
@@ -0,0 +1,208 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit limits the rate at which data goes through the forwards sharing
+// it, counting both directions together.  It can be changed while in use.  A
+// nil *RateLimit does not limit anything.
+type RateLimit struct {
+	mutex   sync.Mutex
+	limiter *rate.Limiter
+
+	// throttled is the time, in nanoseconds, writes were held back for.
+	throttled atomic.Int64
+}
+
+// NewRateLimit returns a rate limit of bytesPerSecond, letting bursts of up to
+// burst bytes through.  A burst that is not positive defaults to one second
+// worth of data, and a rate that is not positive means no limit.
+func NewRateLimit(bytesPerSecond, burst int) *RateLimit {
+	r := &RateLimit{}
+	r.Set(bytesPerSecond, burst)
+
+	return r
+}
+
+// Set changes the rate and burst of the limit, as described by NewRateLimit.
+// Writes already held back are not affected.
+func (r *RateLimit) Set(bytesPerSecond, burst int) {
+	limit := rate.Limit(bytesPerSecond)
+	if bytesPerSecond <= 0 {
+		limit = rate.Inf
+	}
+	if burst <= 0 {
+		burst = bytesPerSecond
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// The burst of a limiter cannot be changed, so a new one is needed then.
+	if r.limiter != nil && r.limiter.Burst() == burst {
+		r.limiter.SetLimit(limit)
+		return
+	}
+	r.limiter = rate.NewLimiter(limit, burst)
+}
+
+// Limit returns the rate, in bytes per second, and the burst of the limit.  A
+// rate of zero means no limit.
+func (r *RateLimit) Limit() (bytesPerSecond, burst int) {
+	if r == nil {
+		return 0, 0
+	}
+
+	limiter := r.current()
+	if limiter.Limit() == rate.Inf {
+		return 0, limiter.Burst()
+	}
+
+	return int(limiter.Limit()), limiter.Burst()
+}
+
+// Throttled returns the total time writes were held back by the limit.
+func (r *RateLimit) Throttled() time.Duration {
+	if r == nil {
+		return 0
+	}
+
+	return time.Duration(r.throttled.Load())
+}
+
+func (r *RateLimit) current() *rate.Limiter {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.limiter
+}
+
+// throttle holds back the writes of a forwarded connection according to the
+// rate limits of its forward and of the tunnel.
+type throttle struct {
+	ctx    context.Context
+	limits []*RateLimit
+
+	// throttled is the time, in nanoseconds, the connection's writes were
+	// held back for, summed over both directions.
+	throttled atomic.Int64
+}
+
+// newThrottle returns a throttle applying the provided limits until the
+// context is done, or nil when none of them is set.
+func newThrottle(ctx context.Context, limits ...*RateLimit) *throttle {
+	t := &throttle{ctx: ctx}
+	for _, limit := range limits {
+		if limit != nil {
+			t.limits = append(t.limits, limit)
+		}
+	}
+
+	if len(t.limits) == 0 {
+		return nil
+	}
+
+	return t
+}
+
+// writer returns a writer holding back the writes to the provided writer.
+func (t *throttle) writer(writer io.Writer) io.Writer {
+	if t == nil {
+		return writer
+	}
+
+	return throttledWriter{writer, t}
+}
+
+// Throttled returns the time the connection's writes were held back for.
+func (t *throttle) Throttled() time.Duration {
+	if t == nil {
+		return 0
+	}
+
+	return time.Duration(t.throttled.Load())
+}
+
+// wait holds back a write of n bytes until every limit lets it through.
+func (t *throttle) wait(n int) error {
+	for _, limit := range t.limits {
+		limiter := limit.current()
+		if limiter.Limit() == rate.Inf {
+			continue
+		}
+
+		started := time.Now()
+		err := waitN(t.ctx, limiter, n)
+		waited := int64(time.Since(started))
+		limit.throttled.Add(waited)
+		t.throttled.Add(waited)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// waitN waits for the limiter to let n bytes through, in several steps when
+// its burst was lowered since the write was sized.
+func waitN(ctx context.Context, limiter *rate.Limiter, n int) error {
+	for n > 0 {
+		step := n
+		if limiter.Limit() != rate.Inf && limiter.Burst() < step {
+			step = limiter.Burst()
+		}
+		if err := limiter.WaitN(ctx, step); err != nil {
+			return err
+		}
+		n -= step
+	}
+
+	return nil
+}
+
+// chunk returns the size of the largest write every limit lets through at
+// once.
+func (t *throttle) chunk(n int) int {
+	for _, limit := range t.limits {
+		limiter := limit.current()
+		if limiter.Limit() != rate.Inf && limiter.Burst() < n {
+			n = limiter.Burst()
+		}
+	}
+
+	return n
+}
+
+type throttledWriter struct {
+	io.Writer
+	throttle *throttle
+}
+
+func (w throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := w.throttle.chunk(len(b) - written)
+		if err := w.throttle.wait(chunk); err != nil {
+			return written, err
+		}
+
+		n, err := w.Writer.Write(b[written : written+chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
@@ -0,0 +1,136 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitSet(t *testing.T) {
+	testcases := []struct {
+		bytesPerSecond int
+		burst          int
+
+		expectedBytesPerSecond int
+		expectedBurst          int
+	}{
+		// Rate and burst are used as provided
+		{
+			bytesPerSecond:         1024,
+			burst:                  512,
+			expectedBytesPerSecond: 1024,
+			expectedBurst:          512,
+		},
+		// Burst defaults to one second worth of data
+		{
+			bytesPerSecond:         2048,
+			expectedBytesPerSecond: 2048,
+			expectedBurst:          2048,
+		},
+		// A rate that is not positive means no limit
+		{
+			bytesPerSecond: -1,
+			expectedBurst:  1,
+		},
+	}
+
+	limit := NewRateLimit(4096, 4096)
+	for _, testcase := range testcases {
+		limit.Set(testcase.bytesPerSecond, testcase.burst)
+
+		bytesPerSecond, burst := limit.Limit()
+		assert.Equal(t, testcase.expectedBytesPerSecond, bytesPerSecond)
+		assert.Equal(t, testcase.expectedBurst, burst)
+	}
+
+	var unset *RateLimit
+	bytesPerSecond, _ := unset.Limit()
+	assert.Equal(t, 0, bytesPerSecond)
+	assert.Equal(t, time.Duration(0), unset.Throttled())
+}
+
+func TestTunnelRateLimit(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	target := newEchoServer(t)
+	defer target.Close()
+
+	// 32 KiB go each way, 64 KiB in total, of which the 16 KiB burst goes
+	// through right away, leaving 48 KiB at 64 KiB/s.
+	payload := bytes.Repeat([]byte("x"), 32<<10)
+
+	testcases := []struct {
+		forward *RateLimit
+		global  *RateLimit
+
+		expectedThrottled bool
+	}{
+		// Limit of the forward
+		{
+			forward:           NewRateLimit(64<<10, 16<<10),
+			expectedThrottled: true,
+		},
+		// Limit of the tunnel
+		{
+			global:            NewRateLimit(64<<10, 16<<10),
+			expectedThrottled: true,
+		},
+		// Limit raised at runtime to no limit
+		{
+			forward: func() *RateLimit {
+				limit := NewRateLimit(1, 1)
+				limit.Set(0, 0)
+				return limit
+			}(),
+		},
+		// No limit
+		{},
+	}
+
+	for _, testcase := range testcases {
+		tunnel, err := New(Options{
+			Hops:         StaticHops(Hop{Username: "test", Signer: signer, Address: server.Addr().String()}),
+			Forwards:     []Forward{{Local: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, Remote: target.Addr(), RateLimit: testcase.forward}},
+			RateLimit:    testcase.global,
+			DrainTimeout: time.Second,
+		})
+		if !assert.Nil(t, err) || !assert.Nil(t, tunnel.Start(context.Background())) {
+			continue
+		}
+
+		conn, err := net.Dial("tcp", tunnel.Addr().String())
+		if assert.Nil(t, err) {
+			started := time.Now()
+			go conn.Write(payload)
+
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			reply := make([]byte, len(payload))
+			_, err = io.ReadFull(conn, reply)
+			elapsed := time.Since(started)
+			assert.Nil(t, err)
+			assert.Equal(t, payload, reply)
+			conn.Close()
+
+			if testcase.expectedThrottled {
+				assert.True(t, elapsed >= 500*time.Millisecond, "transfer took %s", elapsed)
+			} else {
+				assert.True(t, elapsed < 500*time.Millisecond, "transfer took %s", elapsed)
+			}
+		}
+
+		assert.Nil(t, tunnel.Close())
+
+		throttled := testcase.forward.Throttled() + testcase.global.Throttled()
+		assert.Equal(t, testcase.expectedThrottled, throttled > 0)
+	}
+}
@@ -1,62 +1,931 @@
 package tunnel
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"errors"
 	"io"
+	"io/ioutil"
+	"log/slog"
 	"net"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/marcboudreau/go-devops-talk/catapult/capture"
+	"github.com/marcboudreau/go-devops-talk/catapult/trace"
 	"golang.org/x/crypto/ssh"
 )
 
-// Create connects to the specified server and establishes the tunnel.
-func Create(username string, signer ssh.Signer, server, local, remote net.Addr) {
+// Forward describes a local address whose connections are forwarded to a
+// remote address reachable from the server.
+type Forward struct {
+	Local  net.Addr
+	Remote net.Addr
 
-	config := &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	// Listener, when set, is used as the local end of the forward instead of
+	// listening on Local, which defaults to its address.  This allows serving
+	// a socket inherited from the service manager, such as one passed by
+	// systemd socket activation.  The tunnel closes it on shutdown but never
+	// removes its socket file, which remains owned by whoever created it.
+	Listener net.Listener
+
+	// MaxConnections bounds the number of connections forwarded concurrently.
+	// Zero means no bound.
+	MaxConnections int
+
+	// RejectWhenFull closes the connections accepted beyond MaxConnections
+	// instead of leaving them queued until a connection finishes.
+	RejectWhenFull bool
+
+	// IdleTimeout closes connections through which no data went for that
+	// long.  Zero disables it.
+	IdleTimeout time.Duration
+
+	// MaxLifetime closes connections that have been open for that long.  Zero
+	// disables it.
+	MaxLifetime time.Duration
+
+	// DialTimeout bounds the time taken to connect to the remote end for each
+	// accepted connection, including waiting for the SSH connection while it
+	// is down.  Zero means no bound.
+	DialTimeout time.Duration
+
+	// Access controls who may use the local end of the forward.
+	Access Access
+
+	// TLS, when set, makes the local end of the forward serve TLS with this
+	// configuration, which can require client certificates.  The remote end
+	// receives the decrypted traffic.
+	TLS *tls.Config
+
+	// RateLimit limits the rate at which data goes through the forward, in
+	// addition to the tunnel's.  It may be shared with other forwards, which
+	// then share the rate.  It is optional.
+	RateLimit *RateLimit
+}
+
+// Options configures a Tunnel.
+type Options struct {
+	// Hops returns the servers to traverse to reach the server the forwards
+	// are established through.  It is called every time the SSH connection
+	// needs to be (re-)established.
+	Hops HopsFunc
+
+	// Dialer, when set, connects to the remote addresses instead of an SSH
+	// connection of the tunnel's own, in which case Hops is not needed.  It
+	// allows sharing the connection of another process, such as a control
+	// master.
+	Dialer ContextDialer
+
+	// Forwards lists the addresses to forward.  It may be empty when the
+	// tunnel is only used to dial connections in-process with DialContext.
+	// Local TCP addresses can use port 0 and local Unix domain socket
+	// addresses can leave the path empty for the tunnel to choose one, which
+	// Addrs reports.
+	Forwards []Forward
+
+	// HostKeyCallback verifies the host keys presented by the hops that do not
+	// set their own.  When nil, any host key is accepted.
+	HostKeyCallback ssh.HostKeyCallback
+
+	// Keepalive is the interval at which keepalive requests are sent to the
+	// server.  Zero disables them.
+	Keepalive time.Duration
+
+	// DrainTimeout is how long active connections are given to finish once
+	// the tunnel is closed before they are cut.
+	DrainTimeout time.Duration
+
+	// Lazy defers establishing the SSH connection, which includes calling
+	// Hops, until a connection is accepted or dialed.  The remote addresses
+	// are then not checked by Start.
+	Lazy bool
+
+	// IdleDisconnect closes the SSH connection once no connection has been
+	// forwarded or dialed through it for that long.  It is re-established on
+	// demand.  Zero disables it.
+	IdleDisconnect time.Duration
+
+	// RateLimit limits the rate at which data goes through all the forwards
+	// together.  It is optional.
+	RateLimit *RateLimit
+
+	// CloseWhenIdle closes the tunnel instead of only the SSH connection once
+	// IdleDisconnect is reached.  In lazy mode, the tunnel is also closed
+	// when no connection is made for that long after starting.
+	CloseWhenIdle bool
+
+	// Logger receives the tunnel's activity, including a record for every
+	// forwarded connection.  When nil, slog.Default() is used.
+	Logger *slog.Logger
+
+	// Metrics receives measurements of the tunnel's activity.  It is optional.
+	Metrics Metrics
+
+	// Tracer records spans timing the SSH connection and every forwarded
+	// connection.  It is optional.
+	Tracer *trace.Tracer
+
+	// Capture records the data going through every forwarded connection.  It
+	// is optional and not closed by the tunnel.
+	Capture capture.Writer
+}
+
+func (o Options) logger() *slog.Logger {
+	if o.Logger == nil {
+		return slog.Default()
+	}
+
+	return o.Logger
+}
+
+func (o Options) metrics() Metrics {
+	if o.Metrics == nil {
+		return noMetrics{}
+	}
+
+	return o.Metrics
+}
+
+// Event reports a state transition of a tunnel, along with the error that
+// caused it, if any.
+type Event struct {
+	State State
+	Err   error
+}
+
+// Tunnel forwards connections accepted on local addresses to remote addresses
+// reachable from a server over an SSH connection, which is re-established
+// whenever it is lost.
+type Tunnel struct {
+	options Options
+	logger  *slog.Logger
+	metrics Metrics
+	conn    *connection
+	idle    *idleMonitor
+	nextID  atomic.Uint64
+
+	// mutex guards ctx and cancel, which are set by Start while DialContext
+	// and Close may already be called.
+	mutex  sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	listeners []net.Listener
+	// socketDirs are the temporary directories created for the Unix domain
+	// sockets whose path was left for the tunnel to choose.
+	socketDirs []string
+
+	// sockets are the paths of the Unix domain sockets the tunnel bound, to
+	// be removed on shutdown.
+	sockets []string
+
+	done chan struct{}
+	err  error
+
+	eventsMutex  sync.Mutex
+	events       chan Event
+	eventsClosed bool
+}
+
+// New returns a Tunnel configured with the provided options.  It does not
+// connect to the server until Start is called.  A *ListenError wrapping
+// ErrExposed is returned for forwards that would expose a sensitive remote on
+// a non-loopback address without allowing it.
+func New(options Options) (*Tunnel, error) {
+	if options.Hops == nil && options.Dialer == nil {
+		return nil, errors.New("no server provided")
+	}
+
+	// The local addresses chosen by the tunnel are recorded in its own copy.
+	options.Forwards = append([]Forward(nil), options.Forwards...)
+
+	for i := range options.Forwards {
+		forward := &options.Forwards[i]
+		if forward.Local == nil && forward.Listener != nil {
+			forward.Local = forward.Listener.Addr()
+		}
+
+		if err := forward.checkAccess(); err != nil {
+			return nil, err
+		}
+	}
+
+	t := &Tunnel{
+		options: options,
+		logger:  options.logger(),
+		metrics: options.metrics(),
+		done:    make(chan struct{}),
+		events:  make(chan Event, 16),
+	}
+	t.conn = newConnection(options, t.stateChanged)
+	t.idle = newIdleMonitor(options.IdleDisconnect, t.onIdle)
+
+	return t, nil
+}
+
+// Start connects to the server, checks that the remote end of every forward
+// can be reached and opens the local listeners.  It returns once the tunnel is
+// ready to accept connections, or with an *AuthError, *DialError or
+// *ListenError if it cannot be established.  In lazy mode, it only opens the
+// local listeners and the tunnel starts Idle.
+//
+// The tunnel runs until the context is done or Close is called.  The listeners
+// then stop accepting connections and the active ones are given up to the
+// drain timeout to finish before being closed.
+func (t *Tunnel) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	t.mutex.Lock()
+	t.ctx, t.cancel = ctx, cancel
+	t.mutex.Unlock()
+
+	var client *ssh.Client
+	if t.options.Dialer != nil {
+		if err := t.probe(ctx); err != nil {
+			t.fail(err)
+			return err
+		}
+	} else if t.options.Lazy {
+		t.conn.idle()
+	} else {
+		var err error
+		if client, err = t.connect(ctx); err != nil {
+			t.fail(err)
+			return err
+		}
+	}
+
+	for i := range t.options.Forwards {
+		listener, err := t.listen(&t.options.Forwards[i])
+		if err != nil {
+			t.closeListeners()
+			t.removeSockets()
+			if client != nil {
+				// The connection is torn down rather than lost, so it is
+				// withdrawn without reporting it Disconnected.
+				t.conn.setClient(nil)
+				client.Close()
+			}
+			t.fail(err)
+			return err
+		}
+		t.listeners = append(t.listeners, listener)
+	}
+
+	if t.options.Dialer == nil {
+		go t.conn.maintain(ctx, client)
 	}
 
-	client, err := ssh.Dial(server.Network(), server.String(), config)
+	active := newConnectionSet()
+	var accepting sync.WaitGroup
+	for i, listener := range t.listeners {
+		accepting.Add(1)
+		go func(listener net.Listener, forward Forward) {
+			t.accept(ctx, listener, forward, active)
+			accepting.Done()
+		}(listener, t.options.Forwards[i])
+	}
+
+	go func() {
+		<-ctx.Done()
+		t.closeListeners()
+		accepting.Wait()
+
+		t.err = active.drain(t.options.DrainTimeout)
+		t.idle.stop()
+		t.conn.close()
+		t.removeSockets()
+
+		t.emit(Closed, t.err)
+		t.closeEvents()
+		close(t.done)
+	}()
+
+	t.emit(Ready, nil)
+
+	return nil
+}
+
+// connect establishes the SSH connection and checks that the remote end of
+// every forward is reachable through it, so that a missing remote is reported
+// on start rather than for every accepted connection.
+func (t *Tunnel) connect(ctx context.Context) (*ssh.Client, error) {
+	t.emit(Connecting, nil)
+	client, err := t.conn.connect(ctx)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: failed to connect to server %s:%s: %s\n", server.Network(), server.String(), err)
+		return nil, err
+	}
+
+	// The client is only published once every remote end was reached, so
+	// that nothing uses a connection that is about to be closed.
+	for _, forward := range t.options.Forwards {
+		probe, err := client.Dial(forward.Remote.Network(), forward.Remote.String())
+		if err != nil {
+			client.Close()
+			return nil, unreachable(forward.Remote, err)
+		}
+		probe.Close()
+	}
+	t.conn.setState(client, Connected, nil)
+
+	return client, nil
+}
+
+// probe checks that the remote end of every forward is reachable through the
+// dialer.
+func (t *Tunnel) probe(ctx context.Context) error {
+	for _, forward := range t.options.Forwards {
+		probe, err := t.options.Dialer.DialContext(ctx, forward.Remote.Network(), forward.Remote.String())
+		if err != nil {
+			return unreachable(forward.Remote, err)
+		}
+		probe.Close()
+	}
+
+	return nil
+}
+
+// dialRemote connects to the remote address through the dialer, when one is
+// set, or the SSH connection, which it waits for while it is down.  Both the
+// wait and the dial are bound by dialCtx, and end with ErrClosed once the
+// tunnel context is done.
+func (t *Tunnel) dialRemote(ctx, dialCtx context.Context, remote net.Addr) (net.Conn, error) {
+	if t.options.Dialer != nil {
+		conn, err := t.options.Dialer.DialContext(dialCtx, remote.Network(), remote.String())
+		if err != nil && ctx.Err() != nil {
+			return nil, ErrClosed
+		}
+		if err != nil {
+			return nil, asDialError(remote, err)
+		}
+		return conn, nil
+	}
+
+	client := t.conn.current(dialCtx)
+	if client == nil {
+		if ctx.Err() != nil {
+			return nil, ErrClosed
+		}
+		return nil, dialCtx.Err()
+	}
+
+	conn, err := dialClient(dialCtx, client, remote.Network(), remote.String())
+	if err != nil && ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+
+	return conn, err
+}
+
+// onIdle closes the SSH connection, or the whole tunnel when CloseWhenIdle is
+// set, once nothing has used the tunnel for IdleDisconnect.
+func (t *Tunnel) onIdle() {
+	if t.options.CloseWhenIdle {
+		t.logger.Info("closing idle tunnel", "idle_for", t.options.IdleDisconnect)
+		t.stop()
 		return
 	}
-	defer client.Close()
 
-	localListener, err := net.Listen(local.Network(), local.String())
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: failed to open listener socket %s:%s for local end of tunnel: %s\n", local.Network(), local.String(), err)
+	t.logger.Info("disconnecting idle SSH connection", "idle_for", t.options.IdleDisconnect)
+	t.conn.suspend()
+}
+
+// Addr returns the address the listener of the first forward is bound to,
+// which is useful when it was requested with an ephemeral port.  It returns
+// nil before the tunnel is started.
+func (t *Tunnel) Addr() net.Addr {
+	if len(t.listeners) == 0 {
+		return nil
+	}
+
+	return t.listeners[0].Addr()
+}
+
+// Addrs returns the addresses the listeners of all the forwards are bound to,
+// in the order of the forwards.
+func (t *Tunnel) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(t.listeners))
+	for i, listener := range t.listeners {
+		addrs[i] = listener.Addr()
+	}
+
+	return addrs
+}
+
+// Events returns the channel on which the tunnel's state transitions are
+// reported.  Events are dropped when the channel is full, and it is closed
+// once the tunnel has shut down.
+func (t *Tunnel) Events() <-chan Event {
+	return t.events
+}
+
+// Close shuts the tunnel down and waits for it to finish draining.
+func (t *Tunnel) Close() error {
+	t.stop()
+
+	return t.Wait()
+}
+
+// running returns the context the tunnel runs in, or nil before it is started.
+func (t *Tunnel) running() context.Context {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.ctx
+}
+
+// stop cancels the context the tunnel runs in, if it was started.
+func (t *Tunnel) stop() {
+	t.mutex.Lock()
+	cancel := t.cancel
+	t.mutex.Unlock()
+
+	if cancel != nil {
+		cancel()
 	}
-	defer localListener.Close()
+}
+
+// Wait blocks until the tunnel has shut down.  It returns ErrDrainTimeout when
+// active connections had to be cut.
+func (t *Tunnel) Wait() error {
+	<-t.done
+	return t.err
+}
+
+// fail records the error preventing the tunnel from starting and shuts it
+// down.
+func (t *Tunnel) fail(err error) {
+	t.stop()
+	t.err = err
+	t.emit(Closed, err)
+	t.closeEvents()
+	close(t.done)
+}
+
+// maxAcceptDelay bounds the wait between retries of a listener that keeps
+// failing with temporary errors.
+const maxAcceptDelay = time.Second
 
+func (t *Tunnel) accept(ctx context.Context, listener net.Listener, forward Forward, active *connectionSet) {
+	local, remote := listener.Addr(), forward.Remote
+	slots := newLimiter(forward.MaxConnections)
+
+	var dialing sync.WaitGroup
+	defer dialing.Wait()
+
+	var delay time.Duration
 	for {
-		localConn, err := localListener.Accept()
+		// Unless they are rejected, connections beyond the limit wait in the
+		// listener's backlog until a slot is released.
+		if !forward.RejectWhenFull && !slots.acquire(ctx) {
+			return
+		}
+
+		localConn, err := listener.Accept()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: failed to accept connection from listener socket %s:%s: %s", local.Network(), local.String(), err)
+			if !forward.RejectWhenFull {
+				slots.release()
+			}
+			if ctx.Err() != nil {
+				return
+			}
+
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Temporary() {
+				t.logger.Error("failed to accept connection, no longer forwarding", "local", addrString(local), "error", err)
+				return
+			}
+
+			// Temporary failures such as running out of file descriptors
+			// would fail again at once, so wait a growing delay before
+			// retrying.
+			if delay = 2 * delay; delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			t.logger.Warn("failed to accept connection", "local", addrString(local), "retry_in", delay, "error", err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		delay = 0
+		// localConn gets closed once both directions are done below
+
+		if err := forward.authorize(localConn); err != nil {
+			t.logger.Warn("refusing connection",
+				"peer", addrString(localConn.RemoteAddr()),
+				"local", addrString(local),
+				"error", err,
+			)
+			t.metrics.ConnectionRejected(forward)
+			localConn.Close()
+			if !forward.RejectWhenFull {
+				slots.release()
+			}
 			continue
 		}
-		// localConn gets closed in the copyConnection(localConn, remoteConn) function below
 
-		remoteConn, err := client.Dial(remote.Network(), remote.String())
+		if forward.RejectWhenFull && !slots.tryAcquire() {
+			t.logger.Warn("rejecting connection, too many active connections",
+				"peer", addrString(localConn.RemoteAddr()),
+				"local", addrString(local),
+				"max_connections", forward.MaxConnections,
+			)
+			t.metrics.ConnectionRejected(forward)
+			localConn.Close()
+			continue
+		}
+
+		id := t.nextID.Add(1)
+		peer := addrString(localConn.RemoteAddr())
+		logger := t.logger.With(
+			"conn", id,
+			"peer", peer,
+			"local", addrString(local),
+			"remote", addrString(remote),
+		)
+		logger.Debug("connection accepted")
+		t.metrics.ConnectionOpened(forward)
+		started := time.Now()
+
+		forwardCtx, forwardSpan := t.options.Tracer.Start(context.Background(), "tunnel.forward",
+			trace.Int64("conn", int64(id)),
+			trace.String("peer", peer),
+			trace.String("local", addrString(local)),
+			trace.String("remote", addrString(remote)),
+		)
+
+		// The remote end is dialed in the connection's own goroutine, so that
+		// a slow remote does not hold back the connections that follow.  The
+		// shutdown waits for the pending dials, the connections being drained
+		// once they are active.
+		t.idle.hold()
+		dialing.Add(1)
+		go func() {
+			dialCtx, cancelDial := ctx, context.CancelFunc(func() {})
+			if forward.DialTimeout > 0 {
+				dialCtx, cancelDial = context.WithTimeout(ctx, forward.DialTimeout)
+			}
+			_, dialSpan := t.options.Tracer.Start(forwardCtx, "remote.dial")
+			remoteConn, err := t.dialRemote(ctx, dialCtx, remote)
+			cancelDial()
+			// A dial cancelled by the shutdown is not a failure to reach the
+			// remote end.
+			if err != nil && (errors.Is(err, ErrClosed) || ctx.Err() != nil) {
+				dialing.Done()
+				t.idle.release()
+				localConn.Close()
+				slots.release()
+				dialSpan.Finish()
+				forwardSpan.Finish()
+				t.metrics.ConnectionClosed(forward)
+				return
+			}
+			if err != nil {
+				dialing.Done()
+				logger.Warn("failed to connect to remote end of tunnel", "error", err)
+				t.metrics.ConnectionFailed(forward)
+				dialSpan.RecordError(err)
+				dialSpan.Finish()
+				forwardSpan.RecordError(err)
+				forwardSpan.Finish()
+				t.metrics.ConnectionClosed(forward)
+				t.idle.release()
+				slots.release()
+				localConn.Close()
+				return
+			}
+			dialSpan.Finish()
+			// remoteConn gets closed once both directions are done below
+
+			watchdog := newWatchdog(forward.IdleTimeout, forward.MaxLifetime, func(reason string) {
+				logger.Info("closing connection", "reason", reason)
+				localConn.Close()
+				remoteConn.Close()
+			})
+
+			stream := t.openCapture(capture.Conn{
+				ID:      id,
+				Peer:    localConn.RemoteAddr(),
+				Local:   local,
+				Remote:  remote,
+				Started: started,
+			}, logger)
+
+			active.add(localConn, remoteConn)
+			dialing.Done()
+			_, copySpan := t.options.Tracer.Start(forwardCtx, "copy")
+
+			var sent, received int64
+			var sendErr, receiveErr error
+			var wg sync.WaitGroup
+			wg.Add(2)
+
+			throttleCtx, cancelThrottle := context.WithCancel(context.Background())
+			throttle := newThrottle(throttleCtx, forward.RateLimit, t.options.RateLimit)
+
+			// A direction reaching EOF only half-closes the connection it
+			// writes to, while a failing one cuts both directions.
+			abort := func() {
+				cancelThrottle()
+				localConn.Close()
+				remoteConn.Close()
+			}
+			go func() {
+				sent, sendErr = copyConnection(remoteConn, localConn, throttle, func(b []byte) {
+					watchdog.touch()
+					t.metrics.BytesSent(forward, int64(len(b)))
+					stream.Write(capture.Sent, b)
+				})
+				if sendErr != nil {
+					abort()
+				}
+				wg.Done()
+			}()
+			go func() {
+				received, receiveErr = copyConnection(localConn, remoteConn, throttle, func(b []byte) {
+					watchdog.touch()
+					t.metrics.BytesReceived(forward, int64(len(b)))
+					stream.Write(capture.Received, b)
+				})
+				if receiveErr != nil {
+					abort()
+				}
+				wg.Done()
+			}()
+
+			wg.Wait()
+			cancelThrottle()
+			localConn.Close()
+			remoteConn.Close()
+			watchdog.stop()
+			slots.release()
+			if err := stream.Close(); err != nil {
+				logger.Warn("failed to capture connection", "error", err)
+			}
+
+			attrs := []any{"bytes_sent", sent, "bytes_received", received, "duration", time.Since(started)}
+			if throttled := throttle.Throttled(); throttled > 0 {
+				attrs = append(attrs, "throttled", throttled)
+			}
+			if sendErr = copyError(sendErr); sendErr != nil {
+				attrs = append(attrs, "send_error", sendErr)
+				copySpan.RecordError(sendErr)
+			}
+			if receiveErr = copyError(receiveErr); receiveErr != nil {
+				attrs = append(attrs, "receive_error", receiveErr)
+				copySpan.RecordError(receiveErr)
+			}
+			copySpan.SetAttributes(trace.Int64("bytes_sent", sent), trace.Int64("bytes_received", received))
+			copySpan.Finish()
+			forwardSpan.Finish()
+			t.metrics.ConnectionClosed(forward)
+			if sendErr != nil || receiveErr != nil {
+				logger.Warn("connection closed", attrs...)
+			} else {
+				logger.Info("connection closed", attrs...)
+			}
+			active.remove(localConn, remoteConn)
+			t.idle.release()
+		}()
+	}
+}
+
+// listen opens the listener of the local end of the forward.  A Unix domain
+// socket address without a path is replaced by a socket in a private temporary
+// directory, and a stale socket file at the path of one is removed first.  A
+// listener provided by the forward is used as is, apart from serving TLS.
+func (t *Tunnel) listen(forward *Forward) (net.Listener, error) {
+	if forward.Listener != nil {
+		if listener, ok := forward.Listener.(*net.UnixListener); ok {
+			listener.SetUnlinkOnClose(false)
+		}
+		if forward.TLS != nil {
+			return tls.NewListener(forward.Listener, forward.TLS), nil
+		}
+
+		return forward.Listener, nil
+	}
+
+	if addr, ok := forward.Local.(*net.UnixAddr); ok && addr.Name == "" {
+		dir, err := ioutil.TempDir("", "catapult")
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: failed to connect to remote end of tunnel %s:%s: %s", remote.Network(), remote.String(), err)
+			return nil, &ListenError{Network: addr.Network(), Address: addr.String(), Err: err}
+		}
+		t.socketDirs = append(t.socketDirs, dir)
+		forward.Local = &net.UnixAddr{Name: filepath.Join(dir, "tunnel.sock"), Net: addr.Net}
+	}
+
+	if forward.Local.Network() == "unix" {
+		if err := prepareSocket(forward.Local.String(), forward.Access, t.logger); err != nil {
+			return nil, &ListenError{Network: forward.Local.Network(), Address: forward.Local.String(), Err: err}
+		}
+	}
+
+	var listener net.Listener
+	var defaultMode os.FileMode
+	var err error
+	if forward.Local.Network() == "unix" {
+		listener, defaultMode, err = ListenPrivate(forward.Local.Network(), forward.Local.String())
+	} else {
+		listener, err = net.Listen(forward.Local.Network(), forward.Local.String())
+	}
+	if err != nil {
+		return nil, &ListenError{Network: forward.Local.Network(), Address: forward.Local.String(), Err: err}
+	}
+	// An ephemeral port is recorded once chosen, so that the forward passed
+	// to Metrics identifies the listener.
+	forward.Local = listener.Addr()
+	if forward.Local.Network() == "unix" {
+		t.sockets = append(t.sockets, forward.Local.String())
+	}
+
+	if err := forward.secureListener(listener, defaultMode); err != nil {
+		listener.Close()
+		return nil, &ListenError{Network: forward.Local.Network(), Address: forward.Local.String(), Err: err}
+	}
+
+	if forward.TLS != nil {
+		return tls.NewListener(listener, forward.TLS), nil
+	}
+
+	return listener, nil
+}
+
+// removeSockets removes the socket files the tunnel bound, along with the
+// temporary directories created for them.  Socket files of other processes,
+// such as one found in use when listening, are left untouched.
+func (t *Tunnel) removeSockets() {
+	for _, path := range t.sockets {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			t.logger.Warn("failed to remove socket file", "path", path, "error", err)
+		}
+	}
+
+	for _, dir := range t.socketDirs {
+		if err := os.RemoveAll(dir); err != nil {
+			t.logger.Warn("failed to remove socket directory", "path", dir, "error", err)
+		}
+	}
+}
+
+func (t *Tunnel) closeListeners() {
+	for _, listener := range t.listeners {
+		listener.Close()
+	}
+}
+
+// stateChanged arms the idle monitor once the SSH connection is established,
+// or idle when the tunnel closes when idle, and emits the state transition.
+func (t *Tunnel) stateChanged(state State, err error) {
+	if state == Connected || (state == Idle && t.options.CloseWhenIdle) {
+		t.idle.arm()
+	}
+
+	t.emit(state, err)
+}
+
+// emit reports a state transition to the metrics and on the events channel,
+// unless it is full or already closed.
+func (t *Tunnel) emit(state State, err error) {
+	t.metrics.StateChanged(state)
+
+	t.eventsMutex.Lock()
+	defer t.eventsMutex.Unlock()
+
+	if t.eventsClosed {
+		return
+	}
+
+	select {
+	case t.events <- Event{State: state, Err: err}:
+	default:
+	}
+}
+
+func (t *Tunnel) closeEvents() {
+	t.eventsMutex.Lock()
+	defer t.eventsMutex.Unlock()
+
+	t.eventsClosed = true
+	close(t.events)
+}
+
+// copyConnection copies the data read from the reader to the writer, held back
+// by the throttle, calling written with the data of every write.  Once the
+// reader reaches EOF, only the write side of the writer is closed, which
+// passes the EOF on while the other direction may still be going.  It returns
+// the number of bytes copied and the error that interrupted the copy, if any.
+func copyConnection(writer, reader net.Conn, throttle *throttle, written func([]byte)) (int64, error) {
+	n, err := io.Copy(meteredWriter{throttle.writer(writer), written}, reader)
+	if err != nil {
+		return n, err
+	}
+
+	return n, closeWrite(writer)
+}
+
+// closeWrite closes the write side of the connection, which signals EOF to its
+// peer while still reading from it.  Connections that cannot be half-closed,
+// such as a TLS connection whose handshake did not complete, are closed
+// completely.
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		if err := c.CloseWrite(); err == nil {
+			return nil
 		}
-		// remoteConn gets closed in the copyConnection(remoteConn, localConn) function below
+	}
+
+	return conn.Close()
+}
+
+// copyError returns the error that interrupted a copy, unless it was caused by
+// the tunnel closing the connection, as it does when the other direction fails
+// or a limit is reached.
+func copyError(err error) error {
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// connectionSet keeps track of the connections being forwarded so that they
+// can be drained when the tunnel shuts down.
+type connectionSet struct {
+	mutex sync.Mutex
+	conns map[net.Conn]net.Conn
+	wg    sync.WaitGroup
+}
+
+func newConnectionSet() *connectionSet {
+	return &connectionSet{
+		conns: make(map[net.Conn]net.Conn),
+	}
+}
+
+func (s *connectionSet) add(local, remote net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.conns[local] = remote
+	s.wg.Add(1)
+}
+
+func (s *connectionSet) remove(local, remote net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.conns, local)
+	s.wg.Done()
+}
+
+// drain waits up to the provided timeout for the active connections to finish
+// and closes the ones that have not by then.
+func (s *connectionSet) drain(timeout time.Duration) error {
+	s.mutex.Lock()
+	idle := len(s.conns) == 0
+	s.mutex.Unlock()
+	if idle {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
 
-		go copyConnection(remoteConn, localConn)
-		go copyConnection(localConn, remoteConn)
+	s.mutex.Lock()
+	for local, remote := range s.conns {
+		local.Close()
+		remote.Close()
 	}
+	s.mutex.Unlock()
 
+	<-done
+	return ErrDrainTimeout
 }
 
-func copyConnection(writer, reader net.Conn) {
-	if _, err := io.Copy(writer, reader); err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: failed to transfer data in tunnel: %s", err)
+// addrString formats an address as network:address for logging.
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
 	}
 
-	writer.Close()
+	return addr.Network() + ":" + addr.String()
 }
@@ -0,0 +1,485 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marcboudreau/go-devops-talk/catapult/trace"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestTunnelShutdown(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	target := newEchoServer(t)
+	defer target.Close()
+
+	hops := func(context.Context) ([]Hop, error) {
+		return []Hop{{Username: "test", Signer: signer, Address: server.Addr().String()}}, nil
+	}
+
+	dir, err := ioutil.TempDir("", "catapult")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testcases := []struct {
+		closeBeforeTimeout bool
+
+		expected error
+	}{
+		// Active connection finishes while draining
+		{
+			closeBeforeTimeout: true,
+		},
+		// Active connection is cut once the drain timeout elapses
+		{
+			expected: ErrDrainTimeout,
+		},
+	}
+
+	for _, testcase := range testcases {
+		local := &net.UnixAddr{Name: filepath.Join(dir, "tunnel.sock"), Net: "unix"}
+
+		metrics := &recordingMetrics{}
+		spans := &recordingExporter{}
+		tracer := trace.NewTracer(spans, time.Hour, nil)
+		tunnel, err := New(Options{
+			Hops:         hops,
+			Forwards:     []Forward{{Local: local, Remote: target.Addr()}},
+			DrainTimeout: 200 * time.Millisecond,
+			Metrics:      metrics,
+			Tracer:       tracer,
+		})
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if !assert.Nil(t, tunnel.Start(ctx)) {
+			cancel()
+			continue
+		}
+		result := make(chan error, 1)
+		go func() {
+			result <- tunnel.Wait()
+		}()
+
+		addr := tunnel.Addr()
+		assert.Equal(t, local.String(), addr.String())
+
+		conn, err := net.Dial(addr.Network(), addr.String())
+		if !assert.Nil(t, err) {
+			cancel()
+			continue
+		}
+		fmt.Fprint(conn, "hello")
+		reply := make([]byte, 5)
+		_, err = conn.Read(reply)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(reply))
+
+		cancel()
+		if testcase.closeBeforeTimeout {
+			time.Sleep(50 * time.Millisecond)
+			conn.Close()
+		}
+
+		select {
+		case err := <-result:
+			assert.Equal(t, testcase.expected, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("tunnel did not shut down")
+		}
+		conn.Close()
+
+		_, err = os.Stat(local.Name)
+		assert.True(t, os.IsNotExist(err))
+
+		states := []State{}
+		for event := range tunnel.Events() {
+			states = append(states, event.State)
+		}
+		assert.Equal(t, []State{Connecting, Connected, Ready, Closed}, states)
+		assert.Equal(t, states, metrics.states)
+		assert.Equal(t, 1, metrics.opened)
+		assert.Equal(t, 1, metrics.closed)
+		assert.Equal(t, int64(5), metrics.sent)
+		assert.Equal(t, int64(5), metrics.received)
+
+		assert.Nil(t, tracer.Shutdown(context.Background()))
+		assert.Equal(t, []string{"ssh.dial", "ssh.handshake", "ssh.connect", "remote.dial", "copy", "tunnel.forward"}, spans.names)
+	}
+}
+
+// recordingExporter records the names of the exported spans.
+type recordingExporter struct {
+	names []string
+}
+
+func (e *recordingExporter) Export(ctx context.Context, spans []*trace.Span) error {
+	for _, span := range spans {
+		e.names = append(e.names, span.Name)
+	}
+
+	return nil
+}
+
+// recordingMetrics records the measurements reported by a tunnel.
+type recordingMetrics struct {
+	mutex    sync.Mutex
+	states   []State
+	locals   []string
+	opened   int
+	failed   int
+	rejected int
+	closed   int
+	sent     int64
+	received int64
+}
+
+func (m *recordingMetrics) StateChanged(state State) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.states = append(m.states, state)
+}
+
+func (m *recordingMetrics) ConnectionOpened(forward Forward) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.locals = append(m.locals, forward.Local.String())
+	m.opened++
+}
+
+func (m *recordingMetrics) ConnectionFailed(Forward) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.failed++
+}
+
+func (m *recordingMetrics) ConnectionClosed(Forward) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.closed++
+}
+
+func (m *recordingMetrics) BytesSent(forward Forward, n int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sent += n
+}
+
+func (m *recordingMetrics) BytesReceived(forward Forward, n int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.received += n
+}
+
+func TestTunnelStartErrors(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	target := newEchoServer(t)
+	defer target.Close()
+
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+
+	hops := func(context.Context) ([]Hop, error) {
+		return []Hop{{Username: "test", Signer: signer, Address: server.Addr().String()}}, nil
+	}
+	rejectingHops := func(context.Context) ([]Hop, error) {
+		return []Hop{{Username: "test", Signer: signer, Address: server.Addr().String(), HostKeyCallback: ssh.FixedHostKey(signer.PublicKey())}}, nil
+	}
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	unreachableHops := func(context.Context) ([]Hop, error) {
+		return []Hop{{Username: "test", Signer: signer, Address: closed.Addr().String()}}, nil
+	}
+
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	testcases := []struct {
+		hops   HopsFunc
+		local  net.Addr
+		remote net.Addr
+
+		expected            interface{}
+		expectedUnreachable bool
+	}{
+		// Server presents an unexpected host key
+		{
+			hops:     rejectingHops,
+			local:    local,
+			remote:   target.Addr(),
+			expected: &AuthError{},
+		},
+		// Server is unreachable
+		{
+			hops:     unreachableHops,
+			local:    local,
+			remote:   target.Addr(),
+			expected: &DialError{},
+		},
+		// Remote end of the forward is unreachable
+		{
+			hops:                hops,
+			local:               local,
+			remote:              &net.UnixAddr{Name: "/nonexistent/docker.sock", Net: "unix"},
+			expected:            &DialError{},
+			expectedUnreachable: true,
+		},
+		// Local address is already in use
+		{
+			hops:     hops,
+			local:    occupied.Addr(),
+			remote:   target.Addr(),
+			expected: &ListenError{},
+		},
+	}
+
+	for _, testcase := range testcases {
+		metrics := &recordingMetrics{}
+		tunnel, err := New(Options{
+			Hops:     testcase.hops,
+			Forwards: []Forward{{Local: testcase.local, Remote: testcase.remote}},
+			Metrics:  metrics,
+		})
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		err = tunnel.Start(context.Background())
+		assert.IsType(t, testcase.expected, err)
+		assert.Equal(t, testcase.expectedUnreachable, errors.Is(err, ErrRemoteUnreachable))
+		assert.Equal(t, err, tunnel.Wait())
+		assert.Nil(t, tunnel.Addr())
+
+		// A tunnel failing to start never lost a connection it had.
+		assert.NotContains(t, metrics.states, Disconnected)
+
+		// No client is left for new connections to use.
+		done, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.Nil(t, tunnel.conn.current(done))
+	}
+
+}
+
+func TestTunnelRemoteFailure(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	target := newEchoServer(t)
+
+	metrics := &recordingMetrics{}
+	tunnel, err := New(Options{
+		Hops:     StaticHops(Hop{Username: "test", Signer: signer, Address: server.Addr().String()}),
+		Forwards: []Forward{{Local: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, Remote: target.Addr()}},
+		Metrics:  metrics,
+	})
+	if !assert.Nil(t, err) || !assert.Nil(t, tunnel.Start(context.Background())) {
+		return
+	}
+	defer tunnel.Close()
+
+	// The remote end goes away once the tunnel is established.
+	target.Close()
+
+	conn, err := net.Dial("tcp", tunnel.Addr().String())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	assert.Equal(t, 1, metrics.opened)
+	assert.Equal(t, 1, metrics.failed)
+	assert.Equal(t, 1, metrics.closed)
+
+	// Measurements are reported with the port the listener was bound to.
+	assert.Equal(t, []string{tunnel.Addr().String()}, metrics.locals)
+}
+
+func (m *recordingMetrics) ConnectionRejected(Forward) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rejected++
+}
+
+func TestTunnelEphemeralAddresses(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	target := newEchoServer(t)
+	defer target.Close()
+
+	tunnel, err := New(Options{
+		Hops: StaticHops(Hop{Username: "test", Signer: signer, Address: server.Addr().String()}),
+		Forwards: []Forward{
+			{Local: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, Remote: target.Addr()},
+			{Local: &net.UnixAddr{Net: "unix"}, Remote: target.Addr()},
+		},
+		DrainTimeout: time.Second,
+	})
+	if !assert.Nil(t, err) || !assert.Nil(t, tunnel.Start(context.Background())) {
+		return
+	}
+
+	addrs := tunnel.Addrs()
+	if !assert.Len(t, addrs, 2) {
+		tunnel.Close()
+		return
+	}
+	assert.NotEqual(t, 0, addrs[0].(*net.TCPAddr).Port)
+	assert.Equal(t, "tunnel.sock", filepath.Base(addrs[1].String()))
+
+	dir := filepath.Dir(addrs[1].String())
+	info, err := os.Stat(dir)
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	}
+
+	for _, addr := range addrs {
+		conn, err := net.Dial(addr.Network(), addr.String())
+		if assert.Nil(t, err) {
+			assert.Nil(t, echo(conn, "hello"))
+			conn.Close()
+		}
+	}
+
+	assert.Nil(t, tunnel.Close())
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTunnelHalfClose(t *testing.T) {
+	signer, err := CreateSigner(strings.NewReader(testPrivateKey), strings.NewReader(testSignedPublicKey))
+	assert.Nil(t, err)
+
+	server := newTestServer(t)
+	defer server.Close()
+
+	// The target only replies once it has read everything, as a client
+	// half-closing its connection expects.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				request, _ := ioutil.ReadAll(conn)
+				conn.Write(request)
+				conn.Close()
+			}()
+		}
+	}()
+
+	dir, err := ioutil.TempDir("", "catapult")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hops := StaticHops(Hop{Username: "test", Signer: signer, Address: server.Addr().String()})
+
+	testcases := []struct {
+		local  net.Addr
+		dialer ContextDialer
+	}{
+		// TCP local end, through the SSH connection
+		{
+			local: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		},
+		// Unix domain socket local end, through the SSH connection
+		{
+			local: &net.UnixAddr{Name: filepath.Join(dir, "tunnel.sock"), Net: "unix"},
+		},
+		// TCP local end, through a dialer
+		{
+			local:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+			dialer: &net.Dialer{},
+		},
+	}
+
+	for _, testcase := range testcases {
+		metrics := &recordingMetrics{}
+		options := Options{
+			Forwards:     []Forward{{Local: testcase.local, Remote: target.Addr()}},
+			DrainTimeout: time.Second,
+			Metrics:      metrics,
+		}
+		if testcase.dialer != nil {
+			options.Dialer = testcase.dialer
+		} else {
+			options.Hops = hops
+		}
+
+		tunnel, err := New(options)
+		if !assert.Nil(t, err) || !assert.Nil(t, tunnel.Start(context.Background())) {
+			continue
+		}
+
+		addr := tunnel.Addr()
+		conn, err := net.Dial(addr.Network(), addr.String())
+		if assert.Nil(t, err) {
+			fmt.Fprint(conn, "hello")
+			assert.Nil(t, conn.(interface{ CloseWrite() error }).CloseWrite())
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			reply, err := ioutil.ReadAll(conn)
+			assert.Nil(t, err)
+			assert.Equal(t, "hello", string(reply))
+			conn.Close()
+		}
+
+		assert.Nil(t, tunnel.Close())
+
+		metrics.mutex.Lock()
+		assert.Equal(t, int64(5), metrics.sent)
+		assert.Equal(t, int64(5), metrics.received)
+		metrics.mutex.Unlock()
+	}
+}
@@ -5,19 +5,22 @@ server=$1
 private_key=${SSH_PRIVATE_KEY_FILE:-${HOME:-.}/.ssh/id_rsa}
 public_key=${SSH_PUBLIC_KEY_FILE:-${private_key}.pub}
 
-catapult/bin/catapult -k $private_key -p $public_key -l tcp:127.0.0.1:2375 -r unix:/var/run/docker.sock user@$server &
-catapult_pid=$!
-
 echo "Waiting for tunnel to be established..."
 
-while ! netstat -ant | grep LISTEN | grep 2375 >/dev/null; do
-  echo -n "."
-done
-echo ""
+coproc catapult { catapult/bin/catapult -k $private_key -p $public_key -l tcp:127.0.0.1:0 -r unix:/var/run/docker.sock user@$server; }
+catapult_pid=$catapult_PID
+
+# catapult prints "ready <network>:<address>" once the tunnel accepts connections,
+# or exits without printing anything if it could not be established.
+if ! read -r status address <&"${catapult[0]}" || [[ $status != ready ]]; then
+  echo "ERROR: Failed to setup SSH tunnel."
+  exit 1
+fi
 
-export DOCKER_HOST=tcp://127.0.0.1:2375
+export DOCKER_HOST=tcp://${address#tcp:}
 
 docker version
 docker ps -a
 
 kill $catapult_pid
+wait $catapult_pid